@@ -2,13 +2,23 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	errOffsetOutOfRangeReason = "OFFSET_OUT_OF_RANGE"
+	errConditionFailedReason  = "CONDITION_FAILED"
+)
+
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	// Lowest and Next are the log's lowest offset and the offset of the next record appended,
+	// so that clients can reset their position. Both are zero when unknown.
+	Lowest, Next uint64
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
@@ -21,7 +31,16 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 		Locale:  "en-US",
 		Message: msg,
 	}
-	std, err := st.WithDetails(d)
+	info := &errdetails.ErrorInfo{
+		Reason: errOffsetOutOfRangeReason,
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"offset": strconv.FormatUint(e.Offset, 10),
+			"lowest": strconv.FormatUint(e.Lowest, 10),
+			"next":   strconv.FormatUint(e.Next, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
 	if err != nil {
 		return st
 	}
@@ -32,3 +51,175 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// AsErrOffsetOutOfRange recovers ErrOffsetOutOfRange from an error returned by an RPC.
+func AsErrOffsetOutOfRange(err error) (ErrOffsetOutOfRange, bool) {
+	if e, ok := err.(ErrOffsetOutOfRange); ok {
+		return e, true
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return ErrOffsetOutOfRange{}, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != errOffsetOutOfRangeReason {
+			continue
+		}
+
+		var e ErrOffsetOutOfRange
+		e.Offset, _ = strconv.ParseUint(info.Metadata["offset"], 10, 64)
+		e.Lowest, _ = strconv.ParseUint(info.Metadata["lowest"], 10, 64)
+		e.Next, _ = strconv.ParseUint(info.Metadata["next"], 10, 64)
+		return e, true
+	}
+
+	return ErrOffsetOutOfRange{}, false
+}
+
+// ErrOutOfOrderSequence is returned when an idempotent producer sends a sequence
+// other than the one following its last appended record, which isn't a retry
+// of a recently appended record either.
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"out of order sequence for producer %d: %d, expected %d",
+		e.ProducerID, e.Sequence, e.Expected,
+	))
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The producer's records must be sent in the order of their sequences",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned for topics that don't exist.
+type ErrTopicNotFound struct {
+	Name string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Name))
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicOffline is returned for topics whose data directory failed.
+type ErrTopicOffline struct {
+	Name string
+}
+
+func (e ErrTopicOffline) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, fmt.Sprintf("topic offline: %s", e.Name))
+}
+
+func (e ErrTopicOffline) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopicName is returned for topic names other than letters, digits, ".", "_" and "-".
+type ErrInvalidTopicName struct {
+	Name string
+}
+
+func (e ErrInvalidTopicName) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name: %q", e.Name))
+}
+
+func (e ErrInvalidTopicName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTransaction is returned when a transaction isn't open,
+// or is used with a topic that wasn't added to it.
+type ErrInvalidTransaction struct {
+	ID     uint64
+	Reason string
+}
+
+func (e ErrInvalidTransaction) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("invalid transaction %d: %s", e.ID, e.Reason))
+}
+
+func (e ErrInvalidTransaction) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrConditionFailed is returned when the condition of a conditional append
+// doesn't hold. It reports the state of the log the condition was checked against,
+// so that clients can catch up and retry.
+type ErrConditionFailed struct {
+	// NextOffset is the log's next offset.
+	NextOffset uint64
+	// KeyOffset is the offset of the last record with the record's key, if KeyFound.
+	KeyOffset uint64
+	KeyFound  bool
+}
+
+func (e ErrConditionFailed) GRPCStatus() *status.Status {
+	msg := fmt.Sprintf("condition failed: next offset %d", e.NextOffset)
+	if e.KeyFound {
+		msg += fmt.Sprintf(", key offset %d", e.KeyOffset)
+	}
+	st := status.New(codes.FailedPrecondition, msg)
+	info := &errdetails.ErrorInfo{
+		Reason: errConditionFailedReason,
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"next_offset": strconv.FormatUint(e.NextOffset, 10),
+			"key_offset":  strconv.FormatUint(e.KeyOffset, 10),
+			"key_found":   strconv.FormatBool(e.KeyFound),
+		},
+	}
+	std, err := st.WithDetails(info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrConditionFailed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// AsErrConditionFailed recovers ErrConditionFailed from an error returned by an RPC.
+func AsErrConditionFailed(err error) (ErrConditionFailed, bool) {
+	if e, ok := err.(ErrConditionFailed); ok {
+		return e, true
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return ErrConditionFailed{}, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != errConditionFailedReason {
+			continue
+		}
+
+		var e ErrConditionFailed
+		e.NextOffset, _ = strconv.ParseUint(info.Metadata["next_offset"], 10, 64)
+		e.KeyOffset, _ = strconv.ParseUint(info.Metadata["key_offset"], 10, 64)
+		e.KeyFound, _ = strconv.ParseBool(info.Metadata["key_found"])
+		return e, true
+	}
+
+	return ErrConditionFailed{}, false
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+// ResetPolicy decides where a consumer starts when its group has no committed offset,
+// or when its offset is out of the log's range.
+type ResetPolicy int
+
+const (
+	// ResetEarliest starts from the lowest offset in the log.
+	ResetEarliest ResetPolicy = iota
+	// ResetLatest starts from the next record appended to the log.
+	ResetLatest
+	// ResetFail stops the consumer with the ErrOffsetOutOfRange.
+	// Consumers without a committed offset start from offset 0.
+	ResetFail
+	// ResetTime starts from the first record appended at or after the config's ResetTime,
+	// or from the next record appended if there's none.
+	ResetTime
+)
+
+type ConsumerConfig struct {
+	// Topic is the topic to consume, the server's own log if empty.
+	Topic string
+	// Isolation set to READ_COMMITTED only delivers the records of committed transactions.
+	Isolation api.ConsumeRequest_Isolation
+	// Group commits the consumer's offsets and resumes from them.
+	// Consumers without a group start according to Reset.
+	Group string
+	// AutoCommitInterval commits the offset periodically and on Close.
+	// Zero disables auto-commit, so offsets are only committed by Commit.
+	AutoCommitInterval time.Duration
+	Reset              ResetPolicy
+	ResetTime          time.Time
+	// ReconnectBackoff is how long to wait before reconnecting a failed stream.
+	ReconnectBackoff time.Duration
+}
+
+// Consumer delivers the records of the log through Records,
+// reconnecting on stream failures from the record after the last delivered one.
+type Consumer struct {
+	ConsumerConfig
+
+	client api.LogClient
+	logger *zap.Logger
+
+	records chan *api.Record
+
+	mu        sync.Mutex
+	position  uint64 // offset of the next record to deliver
+	committed uint64
+	err       error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewConsumer(client api.LogClient, config ConsumerConfig) (*Consumer, error) {
+	if config.AutoCommitInterval > 0 && config.Group == "" {
+		return nil, errors.New("auto-commit requires a group")
+	}
+	if config.ReconnectBackoff == 0 {
+		config.ReconnectBackoff = 100 * time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Consumer{
+		ConsumerConfig: config,
+		client:         client,
+		logger:         zap.L().Named("consumer"),
+		records:        make(chan *api.Record),
+		ctx:            ctx,
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+
+	position, err := c.startPosition()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.position, c.committed = position, position
+
+	go c.run()
+
+	return c, nil
+}
+
+// Records delivers the records in order. It's closed once the consumer stops,
+// after which Err reports why.
+func (c *Consumer) Records() <-chan *api.Record {
+	return c.records
+}
+
+// Err returns the error that stopped the consumer, or nil if it was closed.
+func (c *Consumer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Position returns the offset of the next record to deliver.
+func (c *Consumer) Position() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position
+}
+
+// Commit commits the offset following the last delivered record for the group.
+func (c *Consumer) Commit(ctx context.Context) error {
+	if c.Group == "" {
+		return errors.New("commit requires a group")
+	}
+
+	c.mu.Lock()
+	position := c.position
+	if position == c.committed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	if _, err := c.client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  c.Group,
+		Offset: position,
+		Topic:  c.Topic,
+	}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.committed = position
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Close stops the consumer, committing its offset if auto-commit is enabled.
+func (c *Consumer) Close() error {
+	c.cancel()
+	<-c.done
+
+	if c.AutoCommitInterval > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return c.Commit(ctx)
+	}
+
+	return nil
+}
+
+func (c *Consumer) startPosition() (uint64, error) {
+	if c.Group != "" {
+		res, err := c.client.FetchOffset(c.ctx, &api.FetchOffsetRequest{Group: c.Group, Topic: c.Topic})
+		if err != nil {
+			return 0, err
+		}
+		if res.Found {
+			return res.Offset, nil
+		}
+	}
+
+	if c.Reset == ResetFail {
+		return 0, nil
+	}
+	return c.reset(api.ErrOffsetOutOfRange{})
+}
+
+// reset returns the offset to resume from according to the reset policy.
+func (c *Consumer) reset(outOfRange api.ErrOffsetOutOfRange) (uint64, error) {
+	if c.Reset == ResetFail {
+		return 0, outOfRange
+	}
+
+	req := &api.GetOffsetsRequest{Topic: c.Topic}
+	if c.Reset == ResetTime {
+		req.Timestamp = c.ResetTime.UnixNano() / int64(time.Millisecond)
+	}
+	res, err := c.client.GetOffsets(c.ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	// read-committed consumers can't read past the last stable offset yet.
+	latest := res.HighWatermark
+	if c.Isolation == api.ConsumeRequest_READ_COMMITTED {
+		latest = res.LastStableOffset
+	}
+
+	switch c.Reset {
+	case ResetLatest:
+		return latest, nil
+	case ResetTime:
+		if res.TimestampFound {
+			return res.TimestampOffset, nil
+		}
+		return latest, nil
+	default:
+		return res.LogStartOffset, nil
+	}
+}
+
+func (c *Consumer) run() {
+	defer close(c.done)
+	defer close(c.records)
+
+	if c.AutoCommitInterval > 0 {
+		go c.autoCommit()
+	}
+
+	for {
+		err := c.consume()
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		if outOfRange, ok := api.AsErrOffsetOutOfRange(err); ok {
+			position, err := c.reset(outOfRange)
+			if err != nil {
+				c.stop(err)
+				return
+			}
+			c.logger.Warn("offset out of range, resetting",
+				zap.Uint64("offset", outOfRange.Offset),
+				zap.Uint64("position", position),
+			)
+			c.mu.Lock()
+			c.position = position
+			c.mu.Unlock()
+			continue
+		}
+
+		if isFatal(err) {
+			c.stop(err)
+			return
+		}
+
+		c.logger.Warn("reconnecting consumer", zap.Error(err))
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.ReconnectBackoff):
+		}
+	}
+}
+
+// consume streams records from the position until the stream fails.
+func (c *Consumer) consume() error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	stream, err := c.client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    c.Position(),
+		Topic:     c.Topic,
+		Isolation: c.Isolation,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case c.records <- res.Record:
+			c.mu.Lock()
+			c.position = res.Record.Offset + 1
+			c.mu.Unlock()
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+func (c *Consumer) autoCommit() {
+	ticker := time.NewTicker(c.AutoCommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Commit(c.ctx); err != nil && c.ctx.Err() == nil {
+				c.logger.Error("failed to commit offset", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (c *Consumer) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// isFatal reports whether reconnecting won't help the stream.
+func isFatal(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.PermissionDenied, codes.Unauthenticated, codes.Unimplemented, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestConsumer_Commit(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	produce(t, client, 3)
+
+	c, err := NewConsumer(client, ConsumerConfig{Group: "group"})
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		require.Equal(t, i, receive(t, c).Offset)
+	}
+	require.NoError(t, c.Commit(context.Background()))
+	require.NoError(t, c.Close())
+
+	res, err := client.FetchOffset(context.Background(), &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.True(t, res.Found)
+	require.Equal(t, uint64(3), res.Offset)
+
+	// resumes from the committed offset
+	c, err = NewConsumer(client, ConsumerConfig{Group: "group"})
+	require.NoError(t, err)
+	defer c.Close()
+	produce(t, client, 1)
+	require.Equal(t, uint64(3), receive(t, c).Offset)
+}
+
+func TestConsumer_AutoCommit(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	produce(t, client, 2)
+
+	c, err := NewConsumer(client, ConsumerConfig{Group: "group", AutoCommitInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	receive(t, c)
+	receive(t, c)
+
+	require.Eventually(t, func() bool {
+		res, err := client.FetchOffset(context.Background(), &api.FetchOffsetRequest{Group: "group"})
+		return err == nil && res.Offset == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Close())
+}
+
+func TestConsumer_ResetLatest(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	produce(t, client, 2)
+
+	c, err := NewConsumer(client, ConsumerConfig{Reset: ResetLatest})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, uint64(2), c.Position())
+
+	produce(t, client, 1)
+	require.Equal(t, uint64(2), receive(t, c).Offset)
+}
+
+func TestConsumer_ResetTime(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{
+				Value:     []byte(fmt.Sprintf("value-%d", i)),
+				Timestamp: start.Add(time.Duration(i)*time.Minute).UnixNano() / int64(time.Millisecond),
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	c, err := NewConsumer(client, ConsumerConfig{Reset: ResetTime, ResetTime: start.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Position())
+	require.NoError(t, c.Close())
+
+	// without any record that recent, it starts from the next one.
+	c, err = NewConsumer(client, ConsumerConfig{Reset: ResetTime, ResetTime: start.Add(time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), c.Position())
+	require.NoError(t, c.Close())
+}
+
+func TestConsumer_OutOfRange(t *testing.T) {
+	client, clog, teardown := setupClientTest(t)
+	defer teardown()
+
+	produce(t, client, 4)
+	_, err := client.CommitOffset(context.Background(), &api.CommitOffsetRequest{Group: "group", Offset: 0})
+	require.NoError(t, err)
+	require.NoError(t, clog.Truncate(1))
+	lowest := clog.LowerOffset()
+	require.NotZero(t, lowest)
+
+	c, err := NewConsumer(client, ConsumerConfig{Group: "group", Reset: ResetEarliest})
+	require.NoError(t, err)
+	require.Equal(t, lowest, receive(t, c).Offset)
+	require.NoError(t, c.Close())
+
+	c, err = NewConsumer(client, ConsumerConfig{Group: "group", Reset: ResetFail})
+	require.NoError(t, err)
+	_, ok := <-c.Records()
+	require.False(t, ok)
+	outOfRange, ok := api.AsErrOffsetOutOfRange(c.Err())
+	require.True(t, ok)
+	require.Equal(t, uint64(0), outOfRange.Offset)
+	require.Equal(t, lowest, outOfRange.Lowest)
+	require.NoError(t, c.Close())
+}
+
+func TestConsumer_Reconnect(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	produce(t, client, 2)
+
+	flaky := &flakyClient{LogClient: client, failures: 2, code: codes.Unavailable}
+	c, err := NewConsumer(flaky, ConsumerConfig{ReconnectBackoff: time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, uint64(0), receive(t, c).Offset)
+	require.Equal(t, uint64(1), receive(t, c).Offset)
+	require.Equal(t, 0, flaky.failures)
+}
+
+func produce(t *testing.T, client api.LogClient, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("value-%d", i))},
+		})
+		require.NoError(t, err)
+	}
+}
+
+func receive(t *testing.T, c *Consumer) *api.Record {
+	t.Helper()
+	select {
+	case record, ok := <-c.Records():
+		require.True(t, ok, "consumer stopped: %v", c.Err())
+		return record
+	case <-time.After(time.Second):
+		t.Fatal("no record received")
+		return nil
+	}
+}
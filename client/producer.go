@@ -0,0 +1,358 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+var ErrProducerClosed = errors.New("producer closed")
+
+// Callback is called once the record has been appended at the offset,
+// or with the error it couldn't be appended with.
+type Callback func(offset uint64, err error)
+
+type ProducerConfig struct {
+	// Topic is the topic to produce to, the server's own log if empty.
+	Topic string
+	// BatchSize flushes the buffered records once there are this many of them.
+	BatchSize int
+	// BatchBytes flushes the buffered records once their values add up to this many bytes.
+	BatchBytes int
+	// Linger flushes the buffered records this long after the first of them was buffered.
+	Linger time.Duration
+	// BufferSize is how many records may be queued before Produce blocks.
+	BufferSize int
+	// MaxRetries is how many times a batch is retried on retriable errors
+	// without any progress before its records fail.
+	MaxRetries int
+	// RetryBackoff is the backoff before the first retry, doubled on every retry
+	// up to MaxRetryBackoff.
+	RetryBackoff, MaxRetryBackoff time.Duration
+	// Idempotent gets a producer ID from the server and numbers the records,
+	// so that records retried after they were appended aren't appended twice.
+	Idempotent bool
+}
+
+func (c *ProducerConfig) setDefaults() {
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = 1 << 20
+	}
+	if c.Linger == 0 {
+		c.Linger = 5 * time.Millisecond
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 5
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = 5 * time.Second
+	}
+}
+
+// Producer buffers records and produces them in batches over ProduceStream.
+//
+// Only one batch is in flight at a time and failed batches are retried from
+// their first unacknowledged record, so records are appended in the order
+// they were produced, which preserves the ordering per key.
+//
+// Idempotent producers set the ProducerId and Sequence of their records.
+type Producer struct {
+	ProducerConfig
+
+	client api.LogClient
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	ops    chan op
+	done   chan struct{}
+
+	stream api.Log_ProduceStreamClient
+	cancel context.CancelFunc
+
+	// producerID and the sequence of the next record when idempotent.
+	// A zero producerID gets a new one before the next batch is sent.
+	producerID, sequence uint64
+}
+
+// op is either a record to produce, or a flush request when flushed is set.
+type op struct {
+	record  *api.Record
+	cb      Callback
+	flushed chan struct{}
+}
+
+func NewProducer(client api.LogClient, config ProducerConfig) (*Producer, error) {
+	config.setDefaults()
+
+	p := &Producer{
+		ProducerConfig: config,
+		client:         client,
+		logger:         zap.L().Named("producer"),
+		ops:            make(chan op, config.BufferSize),
+		done:           make(chan struct{}),
+	}
+	go p.run()
+
+	return p, nil
+}
+
+// Produce queues the record, and calls the callback once it's been produced.
+// It blocks while the buffer is full.
+func (p *Producer) Produce(ctx context.Context, record *api.Record, cb Callback) error {
+	if cb == nil {
+		cb = func(uint64, error) {}
+	}
+	return p.enqueue(ctx, op{record: record, cb: cb})
+}
+
+// Flush blocks until the records queued before it have been produced.
+func (p *Producer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	if err := p.enqueue(ctx, op{flushed: flushed}); err != nil {
+		return err
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Producer) enqueue(ctx context.Context, o op) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrProducerClosed
+	}
+
+	select {
+	case p.ops <- o:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close produces the queued records and stops the producer.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.ops)
+	p.mu.Unlock()
+
+	<-p.done
+	return nil
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+
+	var (
+		batch []op
+		bytes int
+	)
+	linger := time.NewTimer(p.Linger)
+	linger.Stop()
+
+	flush := func() {
+		linger.Stop()
+		if len(batch) > 0 {
+			p.send(batch)
+		}
+		batch, bytes = nil, 0
+	}
+
+	for {
+		select {
+		case o, ok := <-p.ops:
+			if !ok {
+				flush()
+				p.closeStream()
+				return
+			}
+
+			if o.flushed != nil {
+				flush()
+				close(o.flushed)
+				continue
+			}
+
+			batch = append(batch, o)
+			bytes += len(o.record.Value)
+			if len(batch) == 1 {
+				linger.Reset(p.Linger)
+			}
+			if len(batch) >= p.BatchSize || bytes >= p.BatchBytes {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+// send produces the batch, retrying from the first unacknowledged record
+// until every record has either been acknowledged or failed.
+func (p *Producer) send(batch []op) {
+	backoff := p.RetryBackoff
+	attempts := 0
+
+	for len(batch) > 0 {
+		acked, err := p.sendOnce(batch)
+		batch = batch[acked:]
+		if err == nil {
+			continue
+		}
+
+		p.closeStream()
+		if acked > 0 {
+			attempts, backoff = 0, p.RetryBackoff
+		}
+
+		if !isRetriable(err) {
+			// the server rejected the first unacknowledged record.
+			batch[0].cb(0, err)
+			batch = batch[1:]
+			p.resetProducerID()
+			continue
+		}
+
+		attempts++
+		if attempts > p.MaxRetries {
+			for _, o := range batch {
+				o.cb(0, err)
+			}
+			p.resetProducerID()
+			return
+		}
+
+		p.logger.Warn("retrying produce", zap.Int("records", len(batch)), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.MaxRetryBackoff {
+			backoff = p.MaxRetryBackoff
+		}
+	}
+}
+
+// sendOnce sends the batch over the stream and calls back the acknowledged records.
+// It returns how many records were acknowledged before the error, if any.
+func (p *Producer) sendOnce(batch []op) (int, error) {
+	if err := p.initProducer(); err != nil {
+		return 0, err
+	}
+
+	stream, err := p.openStream()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, o := range batch {
+		if p.Idempotent {
+			o.record.ProducerId = p.producerID
+			o.record.Sequence = p.sequence + uint64(i)
+		}
+		if err := stream.Send(&api.ProduceRequest{Record: o.record, Topic: p.Topic}); err != nil {
+			if err == io.EOF {
+				// the stream is broken, the reason is returned by Recv below.
+				break
+			}
+			return 0, err
+		}
+	}
+
+	for i, o := range batch {
+		res, err := stream.Recv()
+		if err != nil {
+			return i, err
+		}
+		p.sequence++
+		o.cb(res.Offset, nil)
+	}
+
+	return len(batch), nil
+}
+
+func (p *Producer) initProducer() error {
+	if !p.Idempotent || p.producerID != 0 {
+		return nil
+	}
+
+	res, err := p.client.InitProducer(context.Background(), &api.InitProducerRequest{})
+	if err != nil {
+		return err
+	}
+
+	p.producerID, p.sequence = res.ProducerId, 0
+	return nil
+}
+
+// resetProducerID drops the producer ID once records have failed.
+// Whether failed records were appended is unknown, so the following records
+// can't reuse their sequences, nor skip them without leaving a gap.
+func (p *Producer) resetProducerID() {
+	p.producerID = 0
+}
+
+func (p *Producer) openStream() (api.Log_ProduceStreamClient, error) {
+	if p.stream != nil {
+		return p.stream, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := p.client.ProduceStream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	p.stream, p.cancel = stream, cancel
+	return stream, nil
+}
+
+func (p *Producer) closeStream() {
+	if p.stream == nil {
+		return
+	}
+
+	_ = p.stream.CloseSend()
+	p.cancel()
+	p.stream, p.cancel = nil, nil
+}
+
+func isRetriable(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+	"github.com/kazukousen/go-distributed/internal/server"
+)
+
+func TestProducer(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	p, err := NewProducer(client, ProducerConfig{BatchSize: 3, Linger: time.Hour})
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		offsets []uint64
+	)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		err := p.Produce(ctx, &api.Record{
+			Key:   []byte(fmt.Sprintf("key-%d", i%2)),
+			Value: []byte(fmt.Sprintf("value-%d", i)),
+		}, func(off uint64, err error) {
+			require.NoError(t, err)
+			mu.Lock()
+			offsets = append(offsets, off)
+			mu.Unlock()
+		})
+		require.NoError(t, err)
+	}
+
+	// the last record is still lingering in the buffer.
+	require.NoError(t, p.Flush(ctx))
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, offsets)
+
+	for i := uint64(0); i < 10; i++ {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: i})
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), res.Record.Value)
+	}
+
+	require.NoError(t, p.Close())
+	require.Equal(t, ErrProducerClosed, p.Produce(ctx, &api.Record{}, nil))
+}
+
+func TestProducer_Linger(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	p, err := NewProducer(client, ProducerConfig{Linger: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer p.Close()
+
+	produced := make(chan uint64, 1)
+	err = p.Produce(context.Background(), &api.Record{Value: []byte("hello world")}, func(off uint64, err error) {
+		require.NoError(t, err)
+		produced <- off
+	})
+	require.NoError(t, err)
+
+	select {
+	case off := <-produced:
+		require.Equal(t, uint64(0), off)
+	case <-time.After(time.Second):
+		t.Fatal("record wasn't flushed after lingering")
+	}
+}
+
+func TestProducer_Retry(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	flaky := &flakyClient{LogClient: client, failures: 2, code: codes.Unavailable}
+	p, err := NewProducer(flaky, ProducerConfig{RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	var errs []error
+	for i := 0; i < 3; i++ {
+		err := p.Produce(context.Background(), &api.Record{Value: []byte("hello world")}, func(_ uint64, err error) {
+			errs = append(errs, err)
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.Close())
+	require.Equal(t, []error{nil, nil, nil}, errs)
+	require.Equal(t, 0, flaky.failures)
+}
+
+func TestProducer_NotRetriable(t *testing.T) {
+	client, _, teardown := setupClientTest(t)
+	defer teardown()
+
+	flaky := &flakyClient{LogClient: client, failures: 1, code: codes.PermissionDenied}
+	p, err := NewProducer(flaky, ProducerConfig{RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	var (
+		offsets []uint64
+		got     []codes.Code
+	)
+	for i := 0; i < 2; i++ {
+		err := p.Produce(context.Background(), &api.Record{Value: []byte("hello world")}, func(off uint64, err error) {
+			offsets = append(offsets, off)
+			got = append(got, status.Code(err))
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.Close())
+
+	// only the first record failed, the rest of the batch went through.
+	require.Equal(t, []codes.Code{codes.PermissionDenied, codes.OK}, got)
+	require.Equal(t, []uint64{0, 0}, offsets)
+}
+
+func TestProducer_Idempotent(t *testing.T) {
+	client, clog, teardown := setupClientTest(t)
+	defer teardown()
+
+	lossy := &lossyClient{LogClient: client, lostAcks: 1}
+	p, err := NewProducer(lossy, ProducerConfig{Idempotent: true, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		err := p.Produce(context.Background(), &api.Record{Value: []byte(fmt.Sprintf("value-%d", i))}, func(off uint64, err error) {
+			require.NoError(t, err)
+			offsets = append(offsets, off)
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.Close())
+
+	// the record whose ack was lost was retried, but appended only once.
+	require.Equal(t, 0, lossy.lostAcks)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+	require.Equal(t, uint64(3), clog.Stats().NextOffset)
+}
+
+// lossyClient loses the given number of acks of the records the server appended.
+type lossyClient struct {
+	api.LogClient
+	lostAcks int
+}
+
+func (c *lossyClient) ProduceStream(ctx context.Context, opts ...grpc.CallOption) (api.Log_ProduceStreamClient, error) {
+	stream, err := c.LogClient.ProduceStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &lossyStream{Log_ProduceStreamClient: stream, client: c}, nil
+}
+
+type lossyStream struct {
+	api.Log_ProduceStreamClient
+	client *lossyClient
+}
+
+func (s *lossyStream) Recv() (*api.ProduceResponse, error) {
+	res, err := s.Log_ProduceStreamClient.Recv()
+	if err == nil && s.client.lostAcks > 0 {
+		s.client.lostAcks--
+		return nil, status.Error(codes.Unavailable, "lossy")
+	}
+	return res, err
+}
+
+// flakyClient fails to open streams the given number of times.
+type flakyClient struct {
+	api.LogClient
+	failures int
+	code     codes.Code
+}
+
+func (c *flakyClient) ConsumeStream(ctx context.Context, req *api.ConsumeRequest, opts ...grpc.CallOption) (api.Log_ConsumeStreamClient, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, status.Error(c.code, "flaky")
+	}
+	return c.LogClient.ConsumeStream(ctx, req, opts...)
+}
+
+func (c *flakyClient) ProduceStream(ctx context.Context, opts ...grpc.CallOption) (api.Log_ProduceStreamClient, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, status.Error(c.code, "flaky")
+	}
+	return c.LogClient.ProduceStream(ctx, opts...)
+}
+
+func setupClientTest(t *testing.T) (api.LogClient, *log.Log, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "client-test")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+	clog, err := log.NewLog(path.Join(dir, "log"), 0, 32, 0)
+	require.NoError(t, err)
+
+	offsets, err := log.NewOffsets(path.Join(dir, "offsets.json"))
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog: clog,
+		Offsets:   offsets,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	return api.NewLogClient(cc), clog, func() {
+		cc.Close()
+		srv.Stop()
+		clog.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -3,17 +3,25 @@ module github.com/kazukousen/go-distributed
 go 1.16
 
 require (
+	contrib.go.opencensus.io/exporter/prometheus v0.4.2
 	github.com/golang/protobuf v1.5.2
-	github.com/grpc-ecosystem/go-grpc-middleware v1.3.0 // indirect
+	github.com/google/btree v1.0.1 // indirect
+	github.com/grpc-ecosystem/go-grpc-middleware v1.3.0
+	github.com/hashicorp/golang-lru v0.5.3 // indirect
 	github.com/hashicorp/memberlist v0.2.4 // indirect
-	github.com/hashicorp/serf v0.9.5 // indirect
+	github.com/hashicorp/serf v0.9.5
+	github.com/prometheus/client_golang v1.13.0
 	github.com/stretchr/testify v1.7.0
-	github.com/travisjeffery/go-dynaport v1.0.0 // indirect
+	github.com/travisjeffery/go-dynaport v1.0.0
 	github.com/tysontate/gommap v0.0.0-20210506040252-ef38c88b18e1
-	go.opencensus.io v0.23.0 // indirect
-	go.uber.org/zap v1.16.0 // indirect
+	go.opencensus.io v0.23.0
+	go.uber.org/multierr v1.5.0
+	go.uber.org/zap v1.16.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/genproto v0.0.0-20210513213006-bf773b8c8384
 	google.golang.org/grpc v1.37.1
-	google.golang.org/protobuf v1.26.0
+	google.golang.org/protobuf v1.28.1
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
 )
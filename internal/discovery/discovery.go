@@ -2,11 +2,17 @@ package discovery
 
 import (
 	"net"
+	"sort"
 
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
 )
 
+// leaderTag tags the member the others replicate from, set to "true".
+const leaderTag = "leader"
+
 type Membership struct {
 	logger  *zap.Logger
 	handler Handler
@@ -92,6 +98,49 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// SetLeader tags the local member as the leader, or untags it, for the other members
+// to report it as the leader in GetServers.
+func (m *Membership) SetLeader(leader bool) error {
+	tags := make(map[string]string, len(m.tags)+1)
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	if leader {
+		tags[leaderTag] = "true"
+	} else {
+		delete(tags, leaderTag)
+	}
+
+	if err := m.serf.SetTags(tags); err != nil {
+		return err
+	}
+	m.tags = tags
+	return nil
+}
+
+// GetServers returns the alive members serving RPCs, sorted by their names.
+// The member tagged as the leader, with SetLeader, is reported as the leader.
+func (m *Membership) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for _, mem := range m.serf.Members() {
+		addr, ok := mem.Tags["rpc_addr"]
+		if mem.Status != serf.StatusAlive || !ok {
+			continue
+		}
+		servers = append(servers, &api.Server{
+			Id:       mem.Name,
+			RpcAddr:  addr,
+			IsLeader: mem.Tags[leaderTag] == "true",
+		})
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+
+	return servers, nil
+}
+
 func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
@@ -27,6 +27,23 @@ func TestMembership(t *testing.T) {
 			0 == len(handler.leaves)
 	}, testEventuallyWaitFor, testEventuallyInterval)
 
+	servers, err := m[1].GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 3)
+	require.Equal(t, "0", servers[0].Id)
+	require.Equal(t, m[0].bindAddr, servers[0].RpcAddr)
+	for _, server := range servers {
+		require.False(t, server.IsLeader)
+	}
+
+	// the member tagged as the leader is reported as the leader.
+	require.NoError(t, m[0].SetLeader(true))
+	require.Eventually(t, func() bool {
+		servers, err := m[1].GetServers()
+		return err == nil && len(servers) == 3 &&
+			servers[0].IsLeader && !servers[1].IsLeader && !servers[2].IsLeader
+	}, testEventuallyWaitFor, testEventuallyInterval)
+
 	require.NoError(t, m[2].Leave())
 
 	require.Eventually(t, func() bool {
@@ -0,0 +1,546 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+const (
+	// EncodingBase64 carries record values as base64 strings, the default.
+	EncodingBase64 = "base64"
+	// EncodingJSON carries record values as raw JSON documents.
+	EncodingJSON = "json"
+
+	defaultBatchLimit = 100
+	maxBatchLimit     = 1000
+	// defaultMaxBodyBytes matches the largest message the gRPC server receives by default.
+	defaultMaxBodyBytes = 4 << 20
+)
+
+// Gateway is a REST/JSON front-end to the Log service:
+//
+//	POST /v1/records                      produces a record, responds with its offset
+//	GET  /v1/records/{offset}             consumes the record at the offset
+//	GET  /v1/records?offset=N&limit=M     consumes up to M records from the offset N, responds
+//	                                      with them and the offset to consume next
+//	GET  /v1/records/stream?offset=N      streams records from the offset N as server-sent events
+//	GET  /v1/offsets?timestamp=T          reports the log's offsets, and the offset of the first
+//	                                      record at or after the time T in Unix milliseconds if given
+//
+// Record values are base64 encoded unless the request has the "encoding=json" query,
+// in which case they are JSON documents. Every endpoint takes the "topic" query,
+// the server's own log being used without it.
+//
+// The Authorization header of the request, e.g. "Bearer <token>", is forwarded to
+// the server, so that the server authenticates and authorizes the request's subject
+// rather than the gateway's own.
+type Gateway struct {
+	Config
+
+	client api.LogClient
+	logger *zap.Logger
+	mux    *http.ServeMux
+}
+
+type Config struct {
+	// AllowAnonymous forwards the requests without an Authorization header under
+	// the gateway's own identity. Otherwise they're rejected as unauthenticated,
+	// since the server couldn't tell whose they are.
+	AllowAnonymous bool
+	// MaxBodyBytes limits the size of the request bodies, 4 MiB by default.
+	// Larger bodies are rejected with 413 Request Entity Too Large.
+	MaxBodyBytes int64
+}
+
+var _ http.Handler = (*Gateway)(nil)
+
+func New(client api.LogClient, config Config) *Gateway {
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	g := &Gateway{
+		Config: config,
+		client: client,
+		logger: zap.L().Named("gateway"),
+		mux:    http.NewServeMux(),
+	}
+	g.mux.HandleFunc("/v1/records", g.handleRecords)
+	g.mux.HandleFunc("/v1/records/", g.handleRecord)
+	g.mux.HandleFunc("/v1/offsets", g.handleOffsets)
+
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+type record struct {
+	Value  json.RawMessage `json:"value"`
+	Offset uint64          `json:"offset"`
+}
+
+type produceRequest struct {
+	Record record `json:"record"`
+}
+
+type produceResponse struct {
+	Offset uint64 `json:"offset"`
+}
+
+type consumeResponse struct {
+	Record record `json:"record"`
+}
+
+type consumeBatchResponse struct {
+	Records    []record `json:"records"`
+	NextOffset uint64   `json:"next_offset"`
+}
+
+type offsetsResponse struct {
+	LogStartOffset   uint64  `json:"log_start_offset"`
+	HighWatermark    uint64  `json:"high_watermark"`
+	LastStableOffset uint64  `json:"last_stable_offset"`
+	TimestampOffset  *uint64 `json:"timestamp_offset,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  uint32 `json:"code"`
+}
+
+func (g *Gateway) handleRecords(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		g.produce(w, r)
+	case http.MethodGet:
+		g.consumeBatch(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		g.writeError(w, status.Error(codes.Unimplemented, "method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) handleRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		g.writeError(w, status.Error(codes.Unimplemented, "method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch p := strings.TrimPrefix(r.URL.Path, "/v1/records/"); p {
+	case "stream":
+		g.consumeStream(w, r)
+	default:
+		off, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			g.writeError(w, status.Errorf(codes.InvalidArgument, "invalid offset %q", p), 0)
+			return
+		}
+		g.consume(w, r, off)
+	}
+}
+
+func (g *Gateway) handleOffsets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		g.writeError(w, status.Error(codes.Unimplemented, "method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	timestamp, err := queryUint(r, "timestamp", 0)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	ctx, err := g.outgoing(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	res, err := g.client.GetOffsets(ctx, &api.GetOffsetsRequest{
+		Topic:     topic(r),
+		Timestamp: int64(timestamp),
+	})
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	out := offsetsResponse{
+		LogStartOffset:   res.LogStartOffset,
+		HighWatermark:    res.HighWatermark,
+		LastStableOffset: res.LastStableOffset,
+	}
+	if res.TimestampFound {
+		out.TimestampOffset = &res.TimestampOffset
+	}
+	g.writeJSON(w, out)
+}
+
+func (g *Gateway) produce(w http.ResponseWriter, r *http.Request) {
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.MaxBodyBytes))
+	if err != nil {
+		g.writeError(w, status.Errorf(codes.InvalidArgument, "failed to read request body: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var req produceRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		g.writeError(w, status.Errorf(codes.InvalidArgument, "invalid request body: %v", err), 0)
+		return
+	}
+
+	value, err := decodeValue(req.Record.Value, encoding)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	ctx, err := g.outgoing(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	res, err := g.client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: value},
+		Topic:  topic(r),
+	})
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	g.writeJSON(w, produceResponse{Offset: res.Offset})
+}
+
+func (g *Gateway) consume(w http.ResponseWriter, r *http.Request, off uint64) {
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	ctx, err := g.outgoing(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	res, err := g.client.Consume(ctx, &api.ConsumeRequest{Offset: off, Topic: topic(r)})
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	rec, err := encodeRecord(res.Record, encoding)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	g.writeJSON(w, consumeResponse{Record: rec})
+}
+
+// consumeBatch reads records from the offset until the limit or the end of the log.
+// A batch starting at the end of the log is empty, so that clients polling for
+// new records aren't answered with an error.
+func (g *Gateway) consumeBatch(w http.ResponseWriter, r *http.Request) {
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+	off, err := queryUint(r, "offset", 0)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+	limit, err := queryUint(r, "limit", defaultBatchLimit)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+	if limit > maxBatchLimit {
+		limit = maxBatchLimit
+	}
+	ctx, err := g.outgoing(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	res := consumeBatchResponse{Records: []record{}, NextOffset: off}
+	for i := uint64(0); i < limit; i++ {
+		consumed, err := g.client.Consume(ctx, &api.ConsumeRequest{Offset: off + i, Topic: topic(r)})
+		if err != nil {
+			if isOffsetOutOfRange(err) && (len(res.Records) > 0 || g.atEnd(ctx, r, off)) {
+				break
+			}
+			g.writeError(w, err, 0)
+			return
+		}
+
+		rec, err := encodeRecord(consumed.Record, encoding)
+		if err != nil {
+			g.writeError(w, err, 0)
+			return
+		}
+		res.Records = append(res.Records, rec)
+		res.NextOffset = rec.Offset + 1
+	}
+
+	g.writeJSON(w, res)
+}
+
+// atEnd reports whether the offset is the next one to be appended to the request's log.
+func (g *Gateway) atEnd(ctx context.Context, r *http.Request, off uint64) bool {
+	offsets, err := g.client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: topic(r)})
+	if err != nil {
+		g.logger.Error("failed to get offsets", zap.Error(err))
+		return false
+	}
+	return off == offsets.HighWatermark
+}
+
+// consumeStream bridges ConsumeStream to server-sent events,
+// sending each record as an event whose ID is the record's offset.
+// Clients reconnecting with the Last-Event-ID header resume after it.
+func (g *Gateway) consumeStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		g.writeError(w, status.Error(codes.Unimplemented, "streaming unsupported"), 0)
+		return
+	}
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+	off, err := queryUint(r, "offset", 0)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			g.writeError(w, status.Errorf(codes.InvalidArgument, "invalid Last-Event-ID %q", id), 0)
+			return
+		}
+		off = last + 1
+	}
+
+	ctx, err := g.outgoing(r)
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	stream, err := g.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: off, Topic: topic(r)})
+	if err != nil {
+		g.writeError(w, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF && status.Code(err) != codes.Canceled {
+				g.logger.Error("failed to receive", zap.Error(err))
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", mustMarshal(toErrorResponse(err)))
+				flusher.Flush()
+			}
+			return
+		}
+
+		rec, err := encodeRecord(res.Record, encoding)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", mustMarshal(toErrorResponse(err)))
+			flusher.Flush()
+			return
+		}
+
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", rec.Offset, mustMarshal(rec))
+		flusher.Flush()
+	}
+}
+
+// outgoing returns the context of the calls made to the server for the request,
+// carrying the request's credentials.
+func (g *Gateway) outgoing(r *http.Request) (context.Context, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		if g.AllowAnonymous {
+			return r.Context(), nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "the request has no Authorization header")
+	}
+	return metadata.AppendToOutgoingContext(r.Context(), "authorization", auth), nil
+}
+
+func topic(r *http.Request) string {
+	return r.URL.Query().Get("topic")
+}
+
+func requestEncoding(r *http.Request) (string, error) {
+	switch e := r.URL.Query().Get("encoding"); e {
+	case "", EncodingBase64:
+		return EncodingBase64, nil
+	case EncodingJSON:
+		return EncodingJSON, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "unknown encoding %q", e)
+	}
+}
+
+func queryUint(r *http.Request, key string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s %q", key, v)
+	}
+	return n, nil
+}
+
+func decodeValue(v json.RawMessage, encoding string) ([]byte, error) {
+	if encoding == EncodingJSON {
+		return []byte(v), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "value must be a base64 string")
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid base64 value: %v", err)
+	}
+	return b, nil
+}
+
+func encodeRecord(r *api.Record, encoding string) (record, error) {
+	if encoding == EncodingJSON {
+		if !json.Valid(r.Value) {
+			return record{}, status.Errorf(codes.FailedPrecondition, "record %d isn't a JSON document", r.Offset)
+		}
+		return record{Value: r.Value, Offset: r.Offset}, nil
+	}
+
+	return record{
+		Value:  mustMarshal(base64.StdEncoding.EncodeToString(r.Value)),
+		Offset: r.Offset,
+	}, nil
+}
+
+func isOffsetOutOfRange(err error) bool {
+	return status.Code(err) == status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+}
+
+func (g *Gateway) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		g.logger.Error("failed to write response", zap.Error(err))
+	}
+}
+
+// writeError writes the error with the HTTP status corresponding to its gRPC code,
+// unless the HTTP status is given.
+func (g *Gateway) writeError(w http.ResponseWriter, err error, httpStatus int) {
+	if httpStatus == 0 {
+		httpStatus = httpStatusFromCode(status.Code(err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(toErrorResponse(err)); err != nil {
+		g.logger.Error("failed to write response", zap.Error(err))
+	}
+}
+
+func toErrorResponse(err error) errorResponse {
+	st, ok := status.FromError(err)
+	if !ok {
+		return errorResponse{Error: err.Error(), Code: uint32(codes.Unknown)}
+	}
+	return errorResponse{Error: st.Message(), Code: uint32(st.Code())}
+}
+
+func httpStatusFromCode(code codes.Code) int {
+	if isHTTPStatus(code) {
+		// some errors, such as ErrOffsetOutOfRange, carry HTTP statuses as their codes.
+		return int(code)
+	}
+
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func isHTTPStatus(code codes.Code) bool {
+	return code >= 400 && code < 600
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+	"github.com/kazukousen/go-distributed/internal/server"
+)
+
+func TestGateway(t *testing.T) {
+	for scenario, f := range map[string]func(t *testing.T, srv *httptest.Server){
+		"produce/consume base64 values":   testGateway_ProduceConsume,
+		"produce/consume raw JSON values": testGateway_ProduceConsumeJSON,
+		"consume batch":                   testGateway_ConsumeBatch,
+		"consume past log boundary fails": testGateway_ConsumePastBoundary,
+		"produce too large a body fails":  testGateway_ProduceTooLarge,
+		"consume stream":                  testGateway_ConsumeStream,
+		"get offsets":                     testGateway_GetOffsets,
+		"produce/consume a topic":         testGateway_Topic,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			srv, teardown := setupGatewayTest(t, nil, Config{AllowAnonymous: true, MaxBodyBytes: 512})
+			defer teardown()
+
+			f(t, srv)
+		})
+	}
+}
+
+func testGateway_ProduceConsume(t *testing.T, srv *httptest.Server) {
+	res := do(t, srv, "POST", "/v1/records", `{"record":{"value":"aGVsbG8gd29ybGQ="}}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"offset":0}`, readBody(t, res))
+
+	res = do(t, srv, "GET", "/v1/records/0", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"record":{"value":"aGVsbG8gd29ybGQ=","offset":0}}`, readBody(t, res))
+}
+
+func testGateway_ProduceConsumeJSON(t *testing.T, srv *httptest.Server) {
+	res := do(t, srv, "POST", "/v1/records?encoding=json", `{"record":{"value":{"hello":"world"}}}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	res = do(t, srv, "GET", "/v1/records/0?encoding=json", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"record":{"value":{"hello":"world"},"offset":0}}`, readBody(t, res))
+}
+
+func testGateway_ConsumeBatch(t *testing.T, srv *httptest.Server) {
+	for _, v := range []string{`1`, `2`, `3`} {
+		res := do(t, srv, "POST", "/v1/records?encoding=json", `{"record":{"value":`+v+`}}`)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	res := do(t, srv, "GET", "/v1/records?offset=1&limit=10&encoding=json", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"records":[{"value":2,"offset":1},{"value":3,"offset":2}],"next_offset":3}`, readBody(t, res))
+
+	// a batch at the end of the log is empty.
+	res = do(t, srv, "GET", "/v1/records?offset=3", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"records":[],"next_offset":3}`, readBody(t, res))
+
+	res = do(t, srv, "GET", "/v1/records?offset=4", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+}
+
+func testGateway_ConsumePastBoundary(t *testing.T, srv *httptest.Server) {
+	res := do(t, srv, "GET", "/v1/records/0", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	var body errorResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Contains(t, body.Error, "offset out of range")
+	res.Body.Close()
+
+	res = do(t, srv, "GET", "/v1/records/nope", "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+}
+
+func testGateway_ProduceTooLarge(t *testing.T, srv *httptest.Server) {
+	value := strings.Repeat("a", 1024)
+	res := do(t, srv, "POST", "/v1/records?encoding=json", `{"record":{"value":"`+value+`"}}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	res.Body.Close()
+
+	res = do(t, srv, "GET", "/v1/offsets", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"log_start_offset":0,"high_watermark":0,"last_stable_offset":0}`, readBody(t, res))
+}
+
+func testGateway_ConsumeStream(t *testing.T, srv *httptest.Server) {
+	for _, v := range []string{`"first"`, `"second"`} {
+		res := do(t, srv, "POST", "/v1/records?encoding=json", `{"record":{"value":`+v+`}}`)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/records/stream?encoding=json", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(res.Body)
+	var lines []string
+	for len(lines) < 2 && scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	require.Equal(t, []string{"id: 1", `data: {"value":"second","offset":1}`}, lines)
+}
+
+func testGateway_GetOffsets(t *testing.T, srv *httptest.Server) {
+	res := do(t, srv, "POST", "/v1/records", `{"record":{"value":"aGVsbG8gd29ybGQ="}}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	res = do(t, srv, "GET", "/v1/offsets", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"log_start_offset":0,"high_watermark":1,"last_stable_offset":1}`, readBody(t, res))
+
+	res = do(t, srv, "GET", "/v1/offsets?timestamp=1", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"log_start_offset":0,"high_watermark":1,"last_stable_offset":1,"timestamp_offset":0}`, readBody(t, res))
+}
+
+func testGateway_Topic(t *testing.T, srv *httptest.Server) {
+	res := do(t, srv, "POST", "/v1/records?topic=orders&encoding=json", `{"record":{"value":"order"}}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"offset":0}`, readBody(t, res))
+
+	res = do(t, srv, "GET", "/v1/records/0?topic=orders&encoding=json", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"record":{"value":"order","offset":0}}`, readBody(t, res))
+
+	// the server's own log is left alone.
+	res = do(t, srv, "GET", "/v1/offsets", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"log_start_offset":0,"high_watermark":0,"last_stable_offset":0}`, readBody(t, res))
+}
+
+func TestGateway_Authorization(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gateway-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile, policyFile := path.Join(dir, "tokens.csv"), path.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("alice-token,alice\nbob-token,bob\n"), 0644))
+	require.NoError(t, os.WriteFile(policyFile, []byte("alice,*,produce\n"), 0644))
+
+	tokens, err := server.NewTokenAuthenticator(server.TokenConfig{TokenFile: tokenFile})
+	require.NoError(t, err)
+	defer tokens.Close()
+	authorizer, err := server.NewPolicyAuthorizer(policyFile)
+	require.NoError(t, err)
+
+	srv, teardown := setupGatewayTest(t, func(config *server.Config) {
+		config.Tokens = tokens
+		config.Authorizer = authorizer
+	}, Config{})
+	defer teardown()
+
+	produce := func(auth string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/v1/records", strings.NewReader(`{"record":{"value":"aGVsbG8gd29ybGQ="}}`))
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// the requests are authorized as their own subjects, not as the gateway.
+	require.Equal(t, http.StatusUnauthorized, produce(""))
+	require.Equal(t, http.StatusUnauthorized, produce("Bearer unknown-token"))
+	require.Equal(t, http.StatusForbidden, produce("Bearer bob-token"))
+	require.Equal(t, http.StatusOK, produce("Bearer alice-token"))
+}
+
+func setupGatewayTest(t *testing.T, fn func(config *server.Config), config Config) (*httptest.Server, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "gateway-test")
+	require.NoError(t, err)
+
+	logDir, topicsDir := path.Join(dir, "log"), path.Join(dir, "topics")
+	for _, d := range []string{logDir, topicsDir} {
+		require.NoError(t, os.Mkdir(d, 0755))
+	}
+
+	clog, err := log.NewLog(logDir, 0, 0, 0)
+	require.NoError(t, err)
+	topics, err := log.NewTopics(topicsDir, 0, 0)
+	require.NoError(t, err)
+
+	serverConfig := &server.Config{CommitLog: clog, Topics: topics}
+	if fn != nil {
+		fn(serverConfig)
+	}
+	gsrv, err := server.NewGRPCServer(serverConfig)
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(New(api.NewLogClient(cc), config))
+
+	return srv, func() {
+		srv.Close()
+		cc.Close()
+		gsrv.Stop()
+		topics.Close()
+		clog.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	res, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+	defer res.Body.Close()
+	var b strings.Builder
+	_, err := bufio.NewReader(res.Body).WriteTo(&b)
+	require.NoError(t, err)
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package loadbalance
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &Picker{}, base.Config{}))
+}
+
+var (
+	_ base.PickerBuilder = (*Picker)(nil)
+	_ balancer.Picker    = (*Picker)(nil)
+)
+
+// consumeMethods are the calls the followers serve as well as the leader.
+var consumeMethods = map[string]bool{
+	"/log.v1.Log/Consume":       true,
+	"/log.v1.Log/ConsumeStream": true,
+}
+
+// Picker sends produce calls to the leader,
+// and spreads consume calls across the followers round-robin.
+// Consume calls fall back to the leader while there's no follower,
+// and any other call goes to the leader.
+// Without a leader, e.g. when the servers don't elect one, every call is
+// spread across the servers round-robin.
+type Picker struct {
+	mu        sync.RWMutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+func (p *Picker) Build(info base.PickerBuildInfo) balancer.Picker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var leader balancer.SubConn
+	var followers []balancer.SubConn
+	for sc, scInfo := range info.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderKey{}).(bool)
+		if isLeader {
+			leader = sc
+			continue
+		}
+		followers = append(followers, sc)
+	}
+	p.leader = leader
+	p.followers = followers
+
+	return p
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var result balancer.PickResult
+	if (p.leader == nil || consumeMethods[info.FullMethodName]) && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+	return p.followers[cur%uint64(len(p.followers))]
+}
@@ -0,0 +1,119 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPicker_NoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPicker_ProducesToLeader(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	// the calls other than the consume calls go to the leader, whatever they're named.
+	for _, method := range []string{"/log.v1.Log/Produce", "/log.v1.Log/CommitOffset", "/log.v1.Log/ConsumerGroups"} {
+		info := balancer.PickInfo{FullMethodName: method}
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPicker_ConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	for _, method := range []string{"/log.v1.Log/Consume", "/log.v1.Log/ConsumeStream"} {
+		info := balancer.PickInfo{FullMethodName: method}
+		seen := map[balancer.SubConn]int{}
+		for i := 0; i < 4; i++ {
+			pick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.NotEqual(t, subConns[0], pick.SubConn)
+			seen[pick.SubConn]++
+		}
+		require.Equal(t, map[balancer.SubConn]int{subConns[1]: 2, subConns[2]: 2}, seen)
+	}
+}
+
+func TestPicker_ConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	leader := &subConn{}
+	picker := &Picker{}
+	picker.Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			leader: {Address: resolver.Address{Attributes: attributes.New(isLeaderKey{}, true)}},
+		},
+	})
+
+	pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"})
+	require.NoError(t, err)
+	require.Equal(t, leader, pick.SubConn)
+}
+
+func TestPicker_SpreadsWithoutLeader(t *testing.T) {
+	picker := &Picker{}
+	subConns := []*subConn{{}, {}}
+	buildInfo := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, sc := range subConns {
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: resolver.Address{
+			Attributes: attributes.New(isLeaderKey{}, false),
+		}}
+	}
+	picker.Build(buildInfo)
+
+	for _, method := range []string{"/log.v1.Log/Produce", "/log.v1.Log/Consume"} {
+		seen := map[balancer.SubConn]int{}
+		for i := 0; i < 4; i++ {
+			pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			seen[pick.SubConn]++
+		}
+		require.Equal(t, map[balancer.SubConn]int{subConns[0]: 2, subConns[1]: 2}, seen)
+	}
+}
+
+func setupPickerTest() (*Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderKey{}, i == 0),
+		}
+		// 0th sub conn is the leader
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := &Picker{}
+	picker.Build(buildInfo)
+	return picker, subConns
+}
+
+// subConn implements balancer.SubConn.
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
@@ -0,0 +1,134 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+// Name is both the scheme of the resolver and the name of the balancer,
+// so clients dial "distributed:///<any server address>" to discover the cluster.
+const Name = "distributed"
+
+// RefreshInterval is how often the resolver refreshes the list of servers.
+var RefreshInterval = 10 * time.Second
+
+type isLeaderKey struct{}
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+var (
+	_ resolver.Builder  = (*Resolver)(nil)
+	_ resolver.Resolver = (*Resolver)(nil)
+)
+
+// Resolver discovers the servers of the cluster by calling GetServers
+// on the server it's been given, and keeps the list up to date.
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+
+	close chan struct{}
+	done  chan struct{}
+}
+
+func (r *Resolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r = &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		close:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+
+	r.serviceConfig = cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name))
+
+	var err error
+	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+
+	return r, nil
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client := api.NewLogClient(r.resolverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), RefreshInterval)
+	defer cancel()
+
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderKey{}, server.IsLeader),
+		})
+	}
+
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+func (r *Resolver) refresh() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) Close() {
+	close(r.close)
+	<-r.done
+
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
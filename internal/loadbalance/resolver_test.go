@@ -0,0 +1,96 @@
+package loadbalance
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+	"github.com/kazukousen/go-distributed/internal/server"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "resolver-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clog, err := log.NewLog(dir, 0, 0, 0)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:    clog,
+		ServerGetter: &getServers{},
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	r, err := (&Resolver{}).Build(
+		resolver.Target{Endpoint: l.Addr().String()},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	want := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New(isLeaderKey{}, true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New(isLeaderKey{}, false),
+		}},
+	}
+	require.Equal(t, want, conn.state)
+
+	conn.state.Addresses = nil
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, want, conn.state)
+}
+
+type getServers struct{}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}, nil
+}
+
+// clientConn implements resolver.ClientConn.
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) {
+	c.state = state
+	// the service config isn't comparable, only the addresses are.
+	c.state.ServiceConfig = nil
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
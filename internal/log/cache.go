@@ -0,0 +1,135 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+)
+
+// recordCache keeps the encoded records last appended or read, up to a number of bytes,
+// evicting the least recently used records first.
+// A nil cache caches nothing.
+type recordCache struct {
+	mu       sync.Mutex
+	maxBytes uint64
+	bytes    uint64
+	lru      *list.List // of *cacheEntry, most recently used first
+	entries  map[uint64]*list.Element
+
+	hits, misses uint64
+}
+
+type cacheEntry struct {
+	off uint64
+	p   []byte
+}
+
+func newRecordCache(maxBytes uint64) *recordCache {
+	return &recordCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[uint64]*list.Element{},
+	}
+}
+
+// get returns the encoded record at the offset if it's cached.
+// The record must not be modified.
+func (c *recordCache) get(off uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[off]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).p, true
+}
+
+// put caches the encoded record at the offset, unless it's larger than the whole cache.
+func (c *recordCache) put(off uint64, p []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if uint64(len(p)) > c.maxBytes {
+		return
+	}
+	if e, ok := c.entries[off]; ok {
+		c.remove(e)
+	}
+	c.entries[off] = c.lru.PushFront(&cacheEntry{off: off, p: p})
+	c.bytes += uint64(len(p))
+	c.evict()
+}
+
+// resize changes how many bytes of records are cached, evicting the records past it.
+func (c *recordCache) resize(maxBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+// removeBelow removes the records below the offset, which were truncated.
+func (c *recordCache) removeBelow(off uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for o, e := range c.entries {
+		if o < off {
+			c.remove(e)
+		}
+	}
+}
+
+// clear removes every record, since their offsets are going to be reused.
+func (c *recordCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = map[uint64]*list.Element{}
+	c.bytes = 0
+}
+
+func (c *recordCache) evict() {
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *recordCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.off)
+	c.bytes -= uint64(len(entry.p))
+}
+
+// stats returns the bytes cached, and how many gets hit and missed the cache.
+func (c *recordCache) stats() (bytes, hits, misses uint64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bytes, c.hits, c.misses
+}
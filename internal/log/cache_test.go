@@ -0,0 +1,56 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordCache(t *testing.T) {
+	c := newRecordCache(8)
+
+	c.put(0, []byte("abc"))
+	c.put(1, []byte("def"))
+	p, ok := c.get(0)
+	require.True(t, ok)
+	require.Equal(t, []byte("abc"), p)
+
+	// evicts the least recently used record, which is 1 since 0 was read.
+	c.put(2, []byte("ghi"))
+	_, ok = c.get(1)
+	require.False(t, ok)
+	_, ok = c.get(0)
+	require.True(t, ok)
+
+	// records larger than the whole cache aren't cached.
+	c.put(3, []byte("too large"))
+	_, ok = c.get(3)
+	require.False(t, ok)
+
+	bytes, hits, misses := c.stats()
+	require.Equal(t, uint64(6), bytes)
+	require.Equal(t, uint64(2), hits)
+	require.Equal(t, uint64(2), misses)
+
+	c.removeBelow(2)
+	_, ok = c.get(0)
+	require.False(t, ok)
+	_, ok = c.get(2)
+	require.True(t, ok)
+
+	c.resize(2)
+	bytes, _, _ = c.stats()
+	require.Equal(t, uint64(0), bytes)
+
+	c.resize(8)
+	c.put(4, []byte("abc"))
+	c.clear()
+	_, ok = c.get(4)
+	require.False(t, ok)
+
+	// a nil cache caches nothing.
+	var none *recordCache
+	none.put(0, []byte("abc"))
+	_, ok = none.get(0)
+	require.False(t, ok)
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// logStartOffsetFile is the checkpoint of the log start offset in the log's directory.
+const logStartOffsetFile = "log-start-offset"
+
+// DeleteRecords deletes the records below the offset, which may be in the middle
+// of a segment, and returns the new log start offset.
+//
+// The records become unreadable as soon as the log start offset is checkpointed,
+// while their segments are only removed once all of their records are deleted,
+// the next time a segment is rolled or the retention is enforced.
+// The log start offset never moves back, nor past the next offset.
+func (l *Log) DeleteRecords(offset uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if next := l.activeSegment.nextOffset; offset > next {
+		offset = next
+	}
+	if offset <= l.lowestOffset() {
+		return l.lowestOffset(), nil
+	}
+
+	if err := writeFileAtomic(
+		path.Join(l.dir, logStartOffsetFile),
+		[]byte(strconv.FormatUint(offset, 10)),
+	); err != nil {
+		return 0, err
+	}
+	l.logStartOffset = offset
+	l.pruneState()
+
+	return offset, nil
+}
+
+func (l *Log) loadLogStartOffset() error {
+	l.logStartOffset = 0
+
+	b, err := os.ReadFile(path.Join(l.dir, logStartOffsetFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	l.logStartOffset, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return err
+}
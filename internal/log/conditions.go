@@ -0,0 +1,54 @@
+package log
+
+import (
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func (l *Log) trackKey(record *api.Record, off uint64) {
+	if len(record.Key) == 0 || record.Control != api.Record_NONE {
+		return
+	}
+
+	l.keyOffsets[string(record.Key)] = off
+}
+
+// pruneKeys forgets the keys whose last records are below the offset.
+func (l *Log) pruneKeys(lowest uint64) {
+	for key, off := range l.keyOffsets {
+		if off < lowest {
+			delete(l.keyOffsets, key)
+		}
+	}
+}
+
+// checkCondition returns api.ErrConditionFailed unless the condition holds
+// for appending the record.
+func (l *Log) checkCondition(record *api.Record, condition *api.Condition) error {
+	if condition == nil {
+		return nil
+	}
+
+	next := l.activeSegment.nextOffset
+	keyOffset, keyFound := l.keyOffsets[string(record.Key)]
+
+	var ok bool
+	switch expected := condition.Expected.(type) {
+	case *api.Condition_NextOffset:
+		ok = expected.NextOffset == next
+	case *api.Condition_KeyOffset:
+		ok = keyFound && expected.KeyOffset == keyOffset
+	case *api.Condition_KeyAbsent:
+		ok = expected.KeyAbsent != keyFound
+	default:
+		ok = true
+	}
+	if ok {
+		return nil
+	}
+
+	return api.ErrConditionFailed{
+		NextOffset: next,
+		KeyOffset:  keyOffset,
+		KeyFound:   keyFound,
+	}
+}
@@ -0,0 +1,280 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// configFile is the configuration last set on the log, in the log's directory.
+// The log is reopened with it, segment sizes included, rather than with the sizes
+// it's opened with.
+const configFile = "config"
+
+// Config is the configuration of a log that can be changed while it's open.
+type Config struct {
+	// MaxStoreBytes and MaxIndexBytes apply to the segments rolled after they're changed.
+	MaxStoreBytes, MaxIndexBytes uint64
+	// RetentionBytes removes the oldest segments while the log is larger than it.
+	// Zero for no limit.
+	RetentionBytes uint64
+	// RetentionTime removes the oldest segments whose records are all older than it.
+	// Zero for no limit.
+	RetentionTime time.Duration
+	// MaxSegmentAge rolls the active segment once it was created longer ago than it,
+	// so that the retention gets to remove the records of logs that rarely fill a segment.
+	// Zero for no limit.
+	MaxSegmentAge time.Duration
+	// CacheBytes keeps the records last appended or read in memory, up to this many bytes,
+	// for the consumers tailing the log. Zero for no cache.
+	CacheBytes uint64
+	// LocalRetentionBytes and LocalRetentionTime offload the oldest segments to the
+	// object store, like the retention removes them, once one is set. LocalRetentionTime
+	// offloads the segments created longer ago than it. Zero for no limit.
+	LocalRetentionBytes uint64
+	LocalRetentionTime  time.Duration
+}
+
+func (l *Log) Config() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return Config{
+		MaxStoreBytes:       l.maxStoreBytes,
+		MaxIndexBytes:       l.maxIndexBytes,
+		RetentionBytes:      l.retentionBytes,
+		RetentionTime:       l.retentionTime,
+		MaxSegmentAge:       l.maxSegmentAge,
+		CacheBytes:          l.cacheBytes(),
+		LocalRetentionBytes: l.localRetentionBytes,
+		LocalRetentionTime:  l.localRetentionTime,
+	}
+}
+
+// SetConfig replaces the configuration of the log, and enforces its retention.
+// Zero segment sizes get their defaults. The configuration is persisted,
+// so that the log keeps it once it's reopened.
+// Once a max segment age is set, the aged segments are also rolled in the background
+// until the log is closed.
+func (l *Log) SetConfig(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := l.setConfig(c.withDefaults()); err != nil {
+		return err
+	}
+	return l.offloadSegments()
+}
+
+func (l *Log) setConfig(c Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path.Join(l.dir, configFile), b); err != nil {
+		return err
+	}
+
+	l.maxStoreBytes, l.maxIndexBytes = c.MaxStoreBytes, c.MaxIndexBytes
+	l.retentionBytes, l.retentionTime = c.RetentionBytes, c.RetentionTime
+	l.maxSegmentAge = c.MaxSegmentAge
+	l.localRetentionBytes, l.localRetentionTime = c.LocalRetentionBytes, c.LocalRetentionTime
+
+	switch {
+	case c.CacheBytes == 0:
+		l.cache = nil
+	case l.cache == nil:
+		l.cache = newRecordCache(c.CacheBytes)
+	default:
+		l.cache.resize(c.CacheBytes)
+	}
+
+	if l.maxSegmentAge > 0 && !l.closed {
+		if l.roller == nil {
+			l.roller = time.NewTicker(rollInterval(l.maxSegmentAge))
+			go l.roll()
+		} else {
+			l.roller.Reset(rollInterval(l.maxSegmentAge))
+		}
+	}
+
+	return l.enforceRetention()
+}
+
+// loadConfig returns the configuration persisted by SetConfig, if any,
+// with the defaults of its zero segment sizes.
+func (l *Log) loadConfig() (*Config, error) {
+	b, err := os.ReadFile(path.Join(l.dir, configFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	c = c.withDefaults()
+	return &c, nil
+}
+
+// Validate returns an error if the segment sizes are too small for a segment to hold
+// a record, which would leave every segment full as soon as it's created.
+func (c Config) Validate() error {
+	if c.MaxStoreBytes != 0 && c.MaxStoreBytes <= recordLengthBytes {
+		return fmt.Errorf("max store bytes must be larger than %d", recordLengthBytes)
+	}
+	if c.MaxIndexBytes != 0 && c.MaxIndexBytes < indexEntireWidth {
+		return fmt.Errorf("max index bytes must be at least %d", indexEntireWidth)
+	}
+	return nil
+}
+
+// withDefaults gives the zero segment sizes their defaults.
+func (c Config) withDefaults() Config {
+	if c.MaxStoreBytes == 0 {
+		c.MaxStoreBytes = 1024
+	}
+	if c.MaxIndexBytes == 0 {
+		c.MaxIndexBytes = 1024
+	}
+	return c
+}
+
+func (l *Log) cacheBytes() uint64 {
+	if l.cache == nil {
+		return 0
+	}
+	return l.cache.maxBytes
+}
+
+// rollInterval is how often the segments are checked for the max segment age,
+// so that they're rolled at most half the age, or a minute, late.
+func rollInterval(age time.Duration) time.Duration {
+	if interval := age / 2; interval < time.Minute {
+		return interval
+	}
+	return time.Minute
+}
+
+// roll rolls the active segment in the background once it's aged,
+// since no appends may come to roll it.
+func (l *Log) roll() {
+	defer close(l.done)
+	defer l.roller.Stop()
+
+	for {
+		select {
+		case <-l.close:
+			return
+		case <-l.roller.C:
+			if err := l.rollAged(); err != nil {
+				zap.L().Named("log").Error("failed to roll aged segment", zap.String("dir", l.dir), zap.Error(err))
+			}
+		}
+	}
+}
+
+// rollAged rolls the active segment if it's older than the max segment age,
+// enforcing the retention on the segments it leaves behind.
+func (l *Log) rollAged() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if !l.activeSegment.IsAged(l.maxSegmentAge, now) {
+		return nil
+	}
+
+	if err := l.rollSegment(l.activeSegment.nextOffset); err != nil {
+		return err
+	}
+	err := l.enforceRetention()
+	l.offloadInBackground()
+	return err
+}
+
+// EnforceRetention removes the segments past the retention, and offloads the ones
+// past the local retention.
+// It's enforced whenever a segment is rolled, so logs that rarely roll
+// need it called periodically for the time-based retention.
+func (l *Log) EnforceRetention() error {
+	l.mu.Lock()
+	err := l.checkOpen()
+	if err == nil {
+		err = l.enforceRetention()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return l.offloadSegments()
+}
+
+// enforceRetention also removes the segments whose records were all deleted.
+// The retention applies to the remote segments along with the local ones, oldest first.
+// It leaves the offloading to offloadSegments, which runs without holding the lock.
+func (l *Log) enforceRetention() error {
+	defer l.pruneState()
+
+	var size uint64
+	for _, rs := range l.remoteSegments {
+		size += rs.StoreBytes + rs.IndexBytes
+	}
+	for _, seg := range l.segments {
+		size += seg.size()
+	}
+	cutoff := time.Now().Add(-l.retentionTime).UnixNano() / int64(time.Millisecond)
+	expired := func(maxTimestamp int64) bool {
+		return l.retentionTime > 0 && maxTimestamp < cutoff
+	}
+
+	for len(l.remoteSegments) > 0 {
+		rs := l.remoteSegments[0]
+		oversized := l.retentionBytes > 0 && size > l.retentionBytes
+		deleted := rs.NextOffset <= l.logStartOffset
+		if !oversized && !expired(rs.MaxTimestamp) && !deleted {
+			// the local segments are all newer.
+			return nil
+		}
+
+		if err := l.removeRemote(); err != nil {
+			return err
+		}
+		l.cache.removeBelow(l.lowestOffset())
+		size -= rs.StoreBytes + rs.IndexBytes
+	}
+
+	// the active segment is never removed.
+	for len(l.segments) > 1 {
+		seg := l.segments[0]
+		oversized := l.retentionBytes > 0 && size > l.retentionBytes
+		deleted := seg.nextOffset <= l.logStartOffset
+		if !oversized && !expired(seg.maxTimestamp) && !deleted {
+			break
+		}
+
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+		size -= seg.size()
+		l.segments = l.segments[1:]
+		l.cache.removeBelow(l.lowestOffset())
+	}
+
+	return nil
+}
@@ -0,0 +1,374 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+type transactionState string
+
+const (
+	transactionOpen       transactionState = "open"
+	transactionCommitting transactionState = "committing"
+	transactionAborting   transactionState = "aborting"
+)
+
+type transaction struct {
+	// Owner is the subject that began the transaction, the only one it's open to.
+	Owner    string           `json:"owner,omitempty"`
+	State    transactionState `json:"state"`
+	Deadline time.Time        `json:"deadline"`
+	Topics   []string         `json:"topics"`
+	// Offsets are the consumer offsets committed along with the transaction,
+	// by topic and group.
+	Offsets map[string]map[string]uint64 `json:"offsets,omitempty"`
+}
+
+func (t *transaction) hasTopic(topic string) bool {
+	for _, name := range t.Topics {
+		if name == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Coordinator runs the transactions spanning the topics.
+//
+// The records of a transaction are appended to the topics as they're produced,
+// and hidden from read-committed reads until the coordinator appends the control
+// record ending the transaction to each of its topics, along with committing
+// its consumer offsets.
+// The decision to commit or abort is persisted before it's carried out,
+// so that it's completed when the coordinator restarts after a crash.
+// The decisions that fail to be carried out, e.g. since a topic is offline,
+// are retried in the background.
+// Open transactions are aborted once they time out.
+//
+// A transaction belongs to the subject that began it: to any other subject,
+// it's as if it didn't exist.
+type Coordinator struct {
+	mu           sync.Mutex
+	path         string
+	topics       *Topics
+	timeout      time.Duration
+	logger       *zap.Logger
+	transactions map[uint64]*transaction
+	lastID       uint64
+
+	close chan struct{}
+	done  chan struct{}
+}
+
+// NewCoordinator loads the transactions from the file at path, completing
+// the ones that were being committed or aborted. The ones that fail to complete
+// are kept pending and retried, rather than failing the coordinator.
+// A zero timeout defaults to one minute.
+func NewCoordinator(path string, topics *Topics, timeout time.Duration) (*Coordinator, error) {
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	c := &Coordinator{
+		path:         path,
+		topics:       topics,
+		timeout:      timeout,
+		logger:       zap.L().Named("coordinator"),
+		transactions: map[uint64]*transaction{},
+		close:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &c.transactions); err != nil {
+			return nil, err
+		}
+	}
+
+	for id, txn := range c.transactions {
+		if id > c.lastID {
+			c.lastID = id
+		}
+		if txn.State != transactionOpen {
+			if err := c.complete(id, txn); err != nil {
+				c.logger.Error("failed to complete transaction", zap.Uint64("transaction_id", id), zap.Error(err))
+			}
+		}
+	}
+
+	go c.expire()
+
+	return c, nil
+}
+
+// Begin begins a transaction for the subject and returns its ID.
+func (c *Coordinator) Begin(owner string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// IDs are taken from the clock, like the producer IDs, so that they stay unique
+	// after the coordinator restarts, whether or not it had persisted them.
+	id := uint64(time.Now().UnixNano())
+	if id <= c.lastID {
+		id = c.lastID + 1
+	}
+	c.lastID = id
+
+	c.transactions[id] = &transaction{
+		Owner:    owner,
+		State:    transactionOpen,
+		Deadline: time.Now().Add(c.timeout),
+	}
+	if err := c.persist(); err != nil {
+		delete(c.transactions, id)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Add adds the topics to the transaction, so that its records can be produced to them.
+func (c *Coordinator) Add(id uint64, owner string, topics ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn, err := c.open(id, owner)
+	if err != nil {
+		return err
+	}
+
+	prev := txn.Topics
+	for _, name := range topics {
+		if txn.hasTopic(name) {
+			continue
+		}
+		if _, err := c.topics.Get(name, true); err != nil {
+			txn.Topics = prev
+			return err
+		}
+		txn.Topics = append(txn.Topics, name)
+	}
+	if err := c.persist(); err != nil {
+		txn.Topics = prev
+		return err
+	}
+
+	return nil
+}
+
+// Append appends the record to the topic as part of its transaction,
+// as long as the condition holds.
+func (c *Coordinator) Append(owner, topic string, record *api.Record, condition *api.Condition) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn, err := c.open(record.TransactionId, owner)
+	if err != nil {
+		return 0, err
+	}
+	if !txn.hasTopic(topic) {
+		return 0, api.ErrInvalidTransaction{
+			ID:     record.TransactionId,
+			Reason: fmt.Sprintf("topic %s wasn't added to the transaction", topic),
+		}
+	}
+
+	t, err := c.topics.Get(topic, false)
+	if err != nil {
+		return 0, err
+	}
+	return t.Log.AppendIf(record, condition)
+}
+
+// CommitOffset commits the group's offset on the topic when the transaction commits.
+func (c *Coordinator) CommitOffset(id uint64, owner, topic, group string, offset uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txn, err := c.open(id, owner)
+	if err != nil {
+		return err
+	}
+	if _, err := c.topics.Get(topic, false); err != nil {
+		return err
+	}
+
+	if txn.Offsets == nil {
+		txn.Offsets = map[string]map[string]uint64{}
+	}
+	if txn.Offsets[topic] == nil {
+		txn.Offsets[topic] = map[string]uint64{}
+	}
+	prev, ok := txn.Offsets[topic][group]
+	txn.Offsets[topic][group] = offset
+	if err := c.persist(); err != nil {
+		if ok {
+			txn.Offsets[topic][group] = prev
+		} else {
+			delete(txn.Offsets[topic], group)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Commit commits the transaction, making its records visible to read-committed reads
+// and committing its offsets.
+func (c *Coordinator) Commit(id uint64, owner string) error {
+	return c.end(id, owner, transactionCommitting)
+}
+
+// Abort aborts the transaction, hiding its records from read-committed reads.
+func (c *Coordinator) Abort(id uint64, owner string) error {
+	return c.end(id, owner, transactionAborting)
+}
+
+func (c *Coordinator) end(id uint64, owner string, state transactionState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if txn, ok := c.transactions[id]; ok && txn.Owner == owner && txn.State == state {
+		// a previous attempt failed halfway, so carry on with it.
+		return c.complete(id, txn)
+	}
+
+	txn, err := c.open(id, owner)
+	if err != nil {
+		return err
+	}
+
+	txn.State = state
+	if err := c.persist(); err != nil {
+		txn.State = transactionOpen
+		return err
+	}
+
+	return c.complete(id, txn)
+}
+
+// complete carries out the decision to commit or abort the transaction.
+// It's safe to complete a transaction again if it failed halfway.
+func (c *Coordinator) complete(id uint64, txn *transaction) error {
+	control := api.Record_COMMIT
+	if txn.State == transactionAborting {
+		control = api.Record_ABORT
+	}
+
+	for _, name := range txn.Topics {
+		t, err := c.topics.Get(name, true)
+		if err != nil {
+			return err
+		}
+		if err := t.Log.EndTransaction(id, control); err != nil {
+			return err
+		}
+	}
+
+	if control == api.Record_COMMIT {
+		for name, groups := range txn.Offsets {
+			t, err := c.topics.Get(name, true)
+			if err != nil {
+				return err
+			}
+			for group, offset := range groups {
+				if err := t.Offsets.Commit(group, offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	delete(c.transactions, id)
+	return c.persist()
+}
+
+// open returns the open transaction, as long as the subject owns it.
+func (c *Coordinator) open(id uint64, owner string) (*transaction, error) {
+	txn, ok := c.transactions[id]
+	// the transactions of other subjects aren't told apart from the ones that don't exist.
+	if !ok || txn.Owner != owner {
+		return nil, api.ErrInvalidTransaction{ID: id, Reason: "not found"}
+	}
+	if txn.State != transactionOpen {
+		return nil, api.ErrInvalidTransaction{ID: id, Reason: fmt.Sprintf("already %s", txn.State)}
+	}
+	return txn, nil
+}
+
+// expire aborts the open transactions past their deadline,
+// and retries completing the ones that failed to.
+func (c *Coordinator) expire() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.close:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			expired := map[uint64]string{}
+			for id, txn := range c.transactions {
+				if txn.State == transactionOpen && now.After(txn.Deadline) {
+					expired[id] = txn.Owner
+				}
+			}
+			for id, txn := range c.transactions {
+				if txn.State == transactionOpen {
+					continue
+				}
+				if err := c.complete(id, txn); err != nil {
+					c.logger.Error("failed to complete transaction", zap.Uint64("transaction_id", id), zap.Error(err))
+				}
+			}
+			c.mu.Unlock()
+
+			for id, owner := range expired {
+				c.logger.Warn("aborting expired transaction", zap.Uint64("transaction_id", id))
+				// the transaction may have ended since it was found expired.
+				if err := c.Abort(id, owner); err != nil && !errors.As(err, &api.ErrInvalidTransaction{}) {
+					c.logger.Error("failed to abort expired transaction", zap.Uint64("transaction_id", id), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+func (c *Coordinator) persist() error {
+	b, err := json.Marshal(c.transactions)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.path, b)
+}
+
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	select {
+	case <-c.close:
+		c.mu.Unlock()
+		return nil
+	default:
+	}
+	close(c.close)
+	c.mu.Unlock()
+
+	<-c.done
+	return nil
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestCoordinator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, topics *Topics){
+		"completes decided transactions on restart":    testCoordinator_Recover,
+		"aborts expired transactions":                  testCoordinator_Expire,
+		"transactions belong to their subject":         testCoordinator_Owner,
+		"retries the transactions failing to complete": testCoordinator_Retry,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "coordinator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			require.NoError(t, os.Mkdir(path.Join(dir, "topics"), 0755))
+			topics, err := NewTopics(path.Join(dir, "topics"), 0, 0)
+			require.NoError(t, err)
+			defer topics.Close()
+
+			fn(t, dir, topics)
+		})
+	}
+}
+
+func testCoordinator_Recover(t *testing.T, dir string, topics *Topics) {
+	c, err := NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+
+	id, err := c.Begin("root")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(id, "root", "out"))
+	_, err = c.Append("root", "out", &api.Record{Value: []byte("hello world"), TransactionId: id}, nil)
+	require.NoError(t, err)
+	_, err = topics.Get("in", true)
+	require.NoError(t, err)
+	require.NoError(t, c.CommitOffset(id, "root", "in", "group", 3))
+
+	// crash right after the decision to commit was persisted.
+	c.transactions[id].State = transactionCommitting
+	require.NoError(t, c.persist())
+	require.NoError(t, c.Close())
+
+	c, err = NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Empty(t, c.transactions)
+
+	out, err := topics.Get("out", false)
+	require.NoError(t, err)
+	record, err := out.Log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	in, err := topics.Get("in", false)
+	require.NoError(t, err)
+	off, ok := in.Offsets.Fetch("group")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), off)
+
+	require.Equal(t, api.ErrInvalidTransaction{ID: id, Reason: "not found"}, c.Commit(id, "root"))
+}
+
+func testCoordinator_Expire(t *testing.T, dir string, topics *Topics) {
+	c, err := NewCoordinator(path.Join(dir, "transactions.json"), topics, 20*time.Millisecond)
+	require.NoError(t, err)
+	defer c.Close()
+
+	id, err := c.Begin("root")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(id, "root", "out"))
+	_, err = c.Append("root", "out", &api.Record{Value: []byte("hello world"), TransactionId: id}, nil)
+	require.NoError(t, err)
+
+	out, err := topics.Get("out", false)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return out.Log.LastStableOffset() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = out.Log.ReadCommitted(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0, Lowest: 0, Next: 2}, err)
+}
+
+func testCoordinator_Owner(t *testing.T, dir string, topics *Topics) {
+	c, err := NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+	defer c.Close()
+
+	id, err := c.Begin("root")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(id, "root", "out"))
+
+	notFound := api.ErrInvalidTransaction{ID: id, Reason: "not found"}
+	require.Equal(t, notFound, c.Add(id, "nobody", "other"))
+	_, err = c.Append("nobody", "out", &api.Record{Value: []byte("hello world"), TransactionId: id}, nil)
+	require.Equal(t, notFound, err)
+	require.Equal(t, notFound, c.CommitOffset(id, "nobody", "out", "group", 1))
+	require.Equal(t, notFound, c.Commit(id, "nobody"))
+	require.Equal(t, notFound, c.Abort(id, "nobody"))
+
+	// the owner is kept when the coordinator restarts.
+	require.NoError(t, c.Close())
+	c, err = NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, notFound, c.Abort(id, "nobody"))
+	require.NoError(t, c.Commit(id, "root"))
+}
+
+func testCoordinator_Retry(t *testing.T, dir string, topics *Topics) {
+	c, err := NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+
+	id, err := c.Begin("root")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(id, "root", "out"))
+	_, err = c.Append("root", "out", &api.Record{Value: []byte("hello world"), TransactionId: id}, nil)
+	require.NoError(t, err)
+
+	// crash right after the decision to commit was persisted, with one of the topics
+	// of the transaction failing to open.
+	blocked := path.Join(dir, "topics", "blocked")
+	require.NoError(t, os.WriteFile(blocked, nil, 0644))
+	c.transactions[id].Topics = append(c.transactions[id].Topics, "blocked")
+	c.transactions[id].State = transactionCommitting
+	require.NoError(t, c.persist())
+	require.NoError(t, c.Close())
+
+	// the coordinator starts anyway, and completes the transaction once it can.
+	c, err = NewCoordinator(path.Join(dir, "transactions.json"), topics, 20*time.Millisecond)
+	require.NoError(t, err)
+	defer c.Close()
+	c.mu.Lock()
+	require.Len(t, c.transactions, 1)
+	c.mu.Unlock()
+
+	require.NoError(t, os.Remove(blocked))
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.transactions) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	out, err := topics.Get("out", false)
+	require.NoError(t, err)
+	record, err := out.Log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
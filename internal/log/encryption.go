@@ -0,0 +1,213 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider provides the keys the records are encrypted with, by their IDs,
+// so that the keys can be rotated while the records encrypted with the previous
+// keys stay readable. An ID must never be reused for another key.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the ID.
+	Key(id uint32) ([]byte, error)
+}
+
+var _ KeyProvider = (*FileKeyProvider)(nil)
+
+// FileKeyProvider provides the keys listed in a file, a key per line as its ID
+// and the hex encoding of a 16, 24 or 32 byte AES key, separated by a space.
+// The last key is the current one, so keys are rotated by appending a new key and
+// reloading the file. Empty lines and lines starting with "#" are ignored.
+type FileKeyProvider struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	return p, p.Reload()
+}
+
+// Reload reads the keys from the file again.
+func (p *FileKeyProvider) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := map[uint32][]byte{}
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want a key ID and a key", p.path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid key ID: %w", p.path, n, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid key: %w", p.path, n, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("%s:%d: %w", p.path, n, err)
+		}
+		keys[uint32(id)] = key
+		current = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys", p.path)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys, p.current = keys, current
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %d not found", id)
+	}
+	return key, nil
+}
+
+const (
+	// encryptedFrame flags the length of the records that are encrypted,
+	// so that the records appended before the encryption was enabled stay readable.
+	encryptedFrame = 1 << 63
+
+	keyIDBytes = 4
+)
+
+var errEncryptedFrame = errors.New("record is encrypted, but the log has no key provider")
+
+// encryptor encrypts and decrypts the records with AES-GCM. An encrypted record
+// is the ID of its key and the nonce, followed by the sealed record.
+// The header and the position of the record in the store are authenticated along
+// with it, so that records can't be moved around.
+type encryptor struct {
+	keys KeyProvider
+
+	mu    sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func newEncryptor(keys KeyProvider) *encryptor {
+	return &encryptor{keys: keys, aeads: map[uint32]cipher.AEAD{}}
+}
+
+func (e *encryptor) seal(pos uint64, p []byte) ([]byte, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, keyIDBytes+aead.NonceSize(), keyIDBytes+aead.NonceSize()+len(p)+aead.Overhead())
+	enc.PutUint32(header, id)
+	if _, err := rand.Read(header[keyIDBytes:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, header[keyIDBytes:], p, additionalData(pos, header)), nil
+}
+
+// open appends the decrypted record to dst.
+func (e *encryptor) open(dst []byte, pos uint64, sealed []byte) ([]byte, error) {
+	if e == nil {
+		return nil, errEncryptedFrame
+	}
+	if len(sealed) < keyIDBytes {
+		return nil, errors.New("encrypted record too short")
+	}
+
+	aead, err := e.aead(enc.Uint32(sealed), nil)
+	if err != nil {
+		return nil, err
+	}
+	prefixBytes := keyIDBytes + aead.NonceSize()
+	if len(sealed) < prefixBytes {
+		return nil, errors.New("encrypted record too short")
+	}
+
+	header := sealed[:prefixBytes]
+	return aead.Open(dst, header[keyIDBytes:], sealed[prefixBytes:], additionalData(pos, header))
+}
+
+// aead returns the cipher of the key with the ID, getting the key from the provider
+// unless it's given.
+func (e *encryptor) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = e.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// additionalData authenticates the position of the record past the header of the store,
+// so that the records of the segments migrated from before there was a header stay readable.
+func additionalData(pos uint64, header []byte) []byte {
+	ad := make([]byte, 8+len(header))
+	enc.PutUint64(ad, pos-headerBytes)
+	copy(ad[8:], header)
+	return ad
+}
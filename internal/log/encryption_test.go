@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+const (
+	testKey1 = "1 000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f\n"
+	testKey2 = "2 0f0e0d0c0b0a09080706050403020100\n"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	f, err := os.CreateTemp("", "keys-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# the current key is the last one\n" + testKey1)
+	require.NoError(t, err)
+
+	keys, err := NewFileKeyProvider(f.Name())
+	require.NoError(t, err)
+	id, key, err := keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), id)
+	require.Len(t, key, 32)
+
+	// rotates the key.
+	_, err = f.WriteString(testKey2)
+	require.NoError(t, err)
+	require.NoError(t, keys.Reload())
+	id, key, err = keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+	require.Len(t, key, 16)
+	_, err = keys.Key(1)
+	require.NoError(t, err)
+	_, err = keys.Key(3)
+	require.Error(t, err)
+
+	_, err = f.WriteString("3 not-hex\n")
+	require.NoError(t, err)
+	require.Error(t, keys.Reload())
+	require.NoError(t, f.Close())
+}
+
+func TestEncryptedLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encrypted-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "keys")
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	// the records appended before the encryption was enabled stay readable.
+	l, err := NewLog(logDir, 0, 0, 0)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("plain")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey1), 0600))
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	l, err = NewEncryptedLog(logDir, 0, 0, 0, keys)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+
+	// the records encrypted with the previous keys stay readable.
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey1+testKey2), 0600))
+	require.NoError(t, keys.Reload())
+	_, err = l.Append(&api.Record{Value: []byte("rotated")})
+	require.NoError(t, err)
+
+	for off, want := range []string{"plain", "secret", "rotated"} {
+		record, err := l.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+	b, err := io.ReadAll(l.Reader())
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(b, []byte("secret")))
+	require.NoError(t, l.Close())
+
+	stored, err := os.ReadFile(path.Join(logDir, "0.store"))
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(stored, []byte("plain")))
+	require.False(t, bytes.Contains(stored, []byte("secret")))
+	require.False(t, bytes.Contains(stored, []byte("rotated")))
+
+	// the encrypted records can't be read without their keys.
+	_, err = NewLog(logDir, 0, 0, 0)
+	require.ErrorIs(t, err, errEncryptedFrame)
+}
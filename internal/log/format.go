@@ -0,0 +1,199 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The store and index files of a segment start with a header:
+//
+//	magic       [4]byte "GDLS" for stores, "GDLI" for indexes
+//	version     uint16  the version of the file format
+//	codec       uint16  how the records are encoded
+//	base offset uint64  the base offset of the segment
+//	created at  int64   when the segment was created, in Unix milliseconds
+//	reserved    [8]byte
+//
+// Segments written before the header was introduced are migrated when they're opened.
+const (
+	headerBytes   = 32
+	formatVersion = 1
+	codecProtobuf = 1
+)
+
+var (
+	storeMagic = []byte("GDLS")
+	indexMagic = []byte("GDLI")
+)
+
+type header struct {
+	magic      []byte
+	version    uint16
+	codec      uint16
+	baseOffset uint64
+	createdAt  int64
+}
+
+func newHeader(magic []byte, baseOffset uint64, createdAt time.Time) header {
+	return header{
+		magic:      magic,
+		version:    formatVersion,
+		codec:      codecProtobuf,
+		baseOffset: baseOffset,
+		createdAt:  createdAt.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (h header) encode() []byte {
+	b := make([]byte, headerBytes)
+	copy(b, h.magic)
+	enc.PutUint16(b[4:], h.version)
+	enc.PutUint16(b[6:], h.codec)
+	enc.PutUint64(b[8:], h.baseOffset)
+	enc.PutUint64(b[16:], uint64(h.createdAt))
+	return b
+}
+
+func decodeHeader(b []byte) header {
+	return header{
+		magic:      b[:4],
+		version:    enc.Uint16(b[4:]),
+		codec:      enc.Uint16(b[6:]),
+		baseOffset: enc.Uint64(b[8:]),
+		createdAt:  int64(enc.Uint64(b[16:])),
+	}
+}
+
+// validate checks that the file is in a format this version can read.
+func (h header) validate(magic []byte, baseOffset uint64) error {
+	if !bytes.Equal(h.magic, magic) {
+		return errors.New("unknown file format")
+	}
+	if h.version == 0 || h.version > formatVersion {
+		return fmt.Errorf("unsupported format version %d", h.version)
+	}
+	if h.codec != codecProtobuf {
+		return fmt.Errorf("unknown codec %d", h.codec)
+	}
+	if h.baseOffset != baseOffset {
+		return fmt.Errorf("base offset is %d, want %d", h.baseOffset, baseOffset)
+	}
+	return nil
+}
+
+// openSegmentFile opens the store or index file of a segment, writing its header
+// if it's new, or validating it otherwise.
+func openSegmentFile(name string, flag int, magic []byte, baseOffset uint64) (*os.File, header, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, header{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, header{}, err
+	}
+
+	if fi.Size() == 0 {
+		h := newHeader(magic, baseOffset, time.Now())
+		if _, err := f.Write(h.encode()); err != nil {
+			f.Close()
+			return nil, header{}, err
+		}
+		return f, h, nil
+	}
+
+	b := make([]byte, headerBytes)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		f.Close()
+		return nil, header{}, fmt.Errorf("%s: %w", name, err)
+	}
+	h := decodeHeader(b)
+	if err := h.validate(magic, baseOffset); err != nil {
+		f.Close()
+		return nil, header{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return f, h, nil
+}
+
+// migrateSegment rewrites the store and index files of a segment written before
+// the header was introduced, prepending the header to them.
+// The files are rewritten atomically, one at a time, so that a migration interrupted
+// halfway is carried on the next time the segment is opened.
+func migrateSegment(dir string, baseOffset uint64) error {
+	storeName := path.Join(dir, fmt.Sprintf("%d.store", baseOffset))
+	migrated, err := migrateFile(storeName, storeMagic, baseOffset, func(b []byte) []byte {
+		return b
+	})
+	if err != nil {
+		return err
+	}
+
+	// the size of the records in the store, which the index entries have to point within.
+	var storeBytes uint64
+	if fi, err := os.Stat(storeName); err == nil && fi.Size() > headerBytes {
+		storeBytes = uint64(fi.Size()) - headerBytes
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	indexName := path.Join(dir, fmt.Sprintf("%d.index", baseOffset))
+	indexMigrated, err := migrateFile(indexName, indexMagic, baseOffset, func(b []byte) []byte {
+		// the records were moved past the store's header. The entries are in order and
+		// point within the store, so the ones that don't are the zeroes left by an index
+		// that wasn't closed.
+		var entries []byte
+		for at := 0; at+indexEntireWidth <= len(b); at += indexEntireWidth {
+			entry := b[at : at+indexEntireWidth]
+			pos := enc.Uint64(entry[indexOffsetWidth:])
+			if enc.Uint32(entry) != uint32(at/indexEntireWidth) || pos+recordLengthBytes > storeBytes {
+				break
+			}
+			enc.PutUint64(entry[indexOffsetWidth:], pos+headerBytes)
+			entries = append(entries, entry...)
+		}
+		return entries
+	})
+	if err != nil {
+		return err
+	}
+
+	if migrated || indexMigrated {
+		zap.L().Named("log").Info(
+			"migrated legacy segment",
+			zap.String("dir", dir),
+			zap.Uint64("base_offset", baseOffset),
+		)
+	}
+	return nil
+}
+
+// migrateFile rewrites the legacy file with a header followed by its converted content.
+// It doesn't touch the files that are new or already have a header.
+func migrateFile(name string, magic []byte, baseOffset uint64, convert func([]byte) []byte) (bool, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(b) == 0 || bytes.HasPrefix(b, magic) {
+		return false, nil
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+
+	h := newHeader(magic, baseOffset, fi.ModTime())
+	return true, writeFileAtomic(name, append(h.encode(), convert(b)...))
+}
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestMigrateLegacySegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "migrate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "keys")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey1), 0600))
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	l, err := NewEncryptedLog(logDir, 0, 0, 0, keys)
+	require.NoError(t, err)
+	for _, value := range []string{"a", "b", "c"} {
+		_, err := l.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// rewrites the segment the way it was written before there was a header.
+	storeName, indexName := path.Join(logDir, "0.store"), path.Join(logDir, "0.index")
+	b, err := os.ReadFile(storeName)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(storeName, b[headerBytes:], 0644))
+	b, err = os.ReadFile(indexName)
+	require.NoError(t, err)
+	legacy := append([]byte{}, b[headerBytes:]...)
+	for at := 0; at < len(legacy); at += indexEntireWidth {
+		pos := enc.Uint64(legacy[at+indexOffsetWidth:])
+		enc.PutUint64(legacy[at+indexOffsetWidth:], pos-headerBytes)
+	}
+	// an index that wasn't closed is left with zeroes past its entries.
+	legacy = append(legacy, make([]byte, 2*indexEntireWidth)...)
+	require.NoError(t, os.WriteFile(indexName, legacy, 0644))
+
+	l, err = NewEncryptedLog(logDir, 0, 0, 0, keys)
+	require.NoError(t, err)
+	off, err := l.Append(&api.Record{Value: []byte("d")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for off, want := range []string{"a", "b", "c", "d"} {
+		record, err := l.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+	require.NoError(t, l.Close())
+
+	for name, magic := range map[string][]byte{storeName: storeMagic, indexName: indexMagic} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(b, magic))
+	}
+}
+
+func TestMigrateEmptyLegacySegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "migrate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// an empty segment that wasn't closed, with its index left full of zeroes.
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.store"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.index"), make([]byte, 1024), 0644))
+
+	s, err := newSegment(dir, 0, 1024, 1024)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), s.nextOffset)
+	require.Equal(t, uint64(0), s.index.size)
+
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, s.store.Commit())
+	record, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(record.Value))
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "header-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newSegment(dir, 16, 1024, 1024)
+	require.NoError(t, err)
+	require.NotZero(t, s.createdAt)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// the header is kept when the segment is reopened.
+	reopened, err := newSegment(dir, 16, 1024, 1024)
+	require.NoError(t, err)
+	require.Equal(t, s.createdAt, reopened.createdAt)
+	require.NoError(t, reopened.Close())
+
+	// a segment whose header doesn't match its name is rejected.
+	for _, ext := range []string{".store", ".index"} {
+		require.NoError(t, os.Rename(path.Join(dir, "16"+ext), path.Join(dir, "17"+ext)))
+	}
+	_, err = newSegment(dir, 17, 1024, 1024)
+	require.Error(t, err)
+
+	// so is a segment written in a newer format.
+	storeName := path.Join(dir, "17.store")
+	b, err := os.ReadFile(storeName)
+	require.NoError(t, err)
+	enc.PutUint64(b[8:], 17)
+	enc.PutUint16(b[4:], formatVersion+1)
+	require.NoError(t, os.WriteFile(storeName, b, 0644))
+	_, err = newSegment(dir, 17, 1024, 1024)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported format version")
+}
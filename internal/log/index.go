@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
 
@@ -13,9 +14,12 @@ const (
 	indexEntireWidth    = indexOffsetWidth + indexPositionsWidth
 )
 
+// index maps the offsets of the records to their positions in the store.
+// Its entries follow the header of the file, which the index leaves to the segment.
 type index struct {
 	f    *os.File
 	mmap gommap.MMap
+	// size is the size of the entries, not counting the header.
 	size uint64
 }
 
@@ -24,10 +28,16 @@ func newIndex(f *os.File, maxIndexBytes int64) (*index, error) {
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
+	if fi.Size() < headerBytes {
+		return nil, fmt.Errorf("%s: missing header", f.Name())
+	}
+	size := uint64(fi.Size() - headerBytes)
 
-	if err := os.Truncate(f.Name(), maxIndexBytes); err != nil {
-		return nil, err
+	// an index written with a larger max size is kept whole, so that its entries stay readable.
+	if fi.Size() < headerBytes+maxIndexBytes {
+		if err := os.Truncate(f.Name(), headerBytes+maxIndexBytes); err != nil {
+			return nil, err
+		}
 	}
 
 	mmap, err := gommap.Map(f.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
@@ -52,7 +62,7 @@ func (idx *index) Close() error {
 		return err
 	}
 
-	if err := idx.f.Truncate(int64(idx.size)); err != nil {
+	if err := idx.f.Truncate(int64(headerBytes + idx.size)); err != nil {
 		return err
 	}
 
@@ -76,10 +86,10 @@ func (idx *index) Last() (off uint32, pos uint64, err error) {
 }
 
 func (idx *index) read(at uint32) (off uint32, pos uint64, err error) {
-	pos = uint64(at) * indexEntireWidth
-	if idx.size < pos+indexEntireWidth {
+	if idx.size < (uint64(at)+1)*indexEntireWidth {
 		return 0, 0, io.EOF
 	}
+	pos = headerBytes + uint64(at)*indexEntireWidth
 
 	off = enc.Uint32(idx.mmap[pos : pos+indexOffsetWidth])
 	pos = enc.Uint64(idx.mmap[pos+indexOffsetWidth : pos+indexEntireWidth])
@@ -87,13 +97,13 @@ func (idx *index) read(at uint32) (off uint32, pos uint64, err error) {
 }
 
 func (idx *index) Write(off uint32, pos uint64) error {
-
-	if uint64(len(idx.mmap)) < idx.size+indexEntireWidth {
+	at := headerBytes + idx.size
+	if uint64(len(idx.mmap)) < at+indexEntireWidth {
 		return io.EOF
 	}
 
-	enc.PutUint32(idx.mmap[idx.size:idx.size+indexOffsetWidth], off)
-	enc.PutUint64(idx.mmap[idx.size+indexOffsetWidth:idx.size+indexEntireWidth], pos)
+	enc.PutUint32(idx.mmap[at:at+indexOffsetWidth], off)
+	enc.PutUint64(idx.mmap[at+indexOffsetWidth:at+indexEntireWidth], pos)
 
 	idx.size += indexEntireWidth
 
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -12,6 +13,8 @@ func TestIndex(t *testing.T) {
 	f, err := os.CreateTemp("", "index_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
+	_, err = f.Write(newHeader(indexMagic, 0, time.Now()).encode())
+	require.NoError(t, err)
 
 	idx, err := newIndex(f, 1024)
 	require.NoError(t, err)
@@ -49,4 +52,16 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].pos, pos)
+	require.NoError(t, idx.Close())
+
+	// an index reopened with a smaller max size keeps the entries past it.
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newIndex(f, indexEntireWidth)
+	require.NoError(t, err)
+	off, pos, err = idx.Last()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+	require.Equal(t, entries[1].pos, pos)
+	require.Equal(t, io.EOF, idx.Write(2, 20))
+	require.NoError(t, idx.Close())
 }
@@ -0,0 +1,76 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFile is the file in the log's directory the log holds a lock on while it's open.
+const lockFile = "LOCK"
+
+// ErrLocked is returned when opening a log whose directory another log holds the lock on,
+// whether in another process or in this one.
+var ErrLocked = errors.New("log directory is locked")
+
+// dirLock is an exclusive lock on a directory, held with flock(2) on its lock file
+// so that it's released by the kernel if the process dies.
+type dirLock struct {
+	f *os.File
+}
+
+func lockDir(dir string) (*dirLock, error) {
+	f, err := os.OpenFile(path.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if pid, ok := lockOwner(f); ok {
+				return nil, fmt.Errorf("%s: %w by process %d", dir, ErrLocked, pid)
+			}
+			return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+		}
+		return nil, err
+	}
+
+	// records who holds the lock, for the error of the next one trying to take it.
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &dirLock{f: f}, nil
+}
+
+func lockOwner(f *os.File) (int, bool) {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid, err == nil
+}
+
+// unlock releases the lock. The lock file is left behind, since removing it would let
+// another log lock a new file while one still waits on the old one.
+func (l *dirLock) unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	defer func() { l.f = nil }()
+
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
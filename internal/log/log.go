@@ -1,13 +1,18 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
 
 	api "github.com/kazukousen/go-distributed/api/v1"
 )
@@ -18,9 +23,115 @@ type Log struct {
 	activeSegment                               *segment
 	segments                                    []*segment
 	initialOffset, maxStoreBytes, maxIndexBytes uint64
+	retentionBytes                              uint64
+	retentionTime                               time.Duration
+	maxSegmentAge                               time.Duration
+
+	appendedRecords, appendedBytes uint64
+
+	// producers tracks the sequences of the idempotent producers by their IDs.
+	producers      map[uint64]*producerState
+	lastProducerID uint64
+
+	// openTransactions maps the transactions without a control record yet
+	// to the offset of their first record.
+	openTransactions map[uint64]uint64
+	// abortedTransactions maps the aborted transactions to the offset of their control record.
+	abortedTransactions map[uint64]uint64
+
+	// keyOffsets maps the keys of the records to the offset of the last record with them.
+	keyOffsets map[string]uint64
+	// prunedOffset is the lowest offset the state of the records was last pruned at.
+	prunedOffset uint64
+
+	// encryptor, if set, encrypts the records of the segments.
+	encryptor *encryptor
+
+	// cache keeps the hot records in memory, if it's configured.
+	cache *recordCache
+
+	// objectStore, if set, holds the segments offloaded past the local retention,
+	// the remote segments, which are all older than the local ones.
+	objectStore         ObjectStore
+	objectPrefix        string
+	remoteSegments      []remoteSegment
+	localRetentionBytes uint64
+	localRetentionTime  time.Duration
+	fetchMu             sync.Mutex
+	fetched             []*segment // the remote segments last fetched, oldest first
+	// offloadMu serializes the offloads, which run without holding mu.
+	offloadMu sync.Mutex
+	// offloads are the offloads running in the background, which the log waits for on close.
+	offloads        sync.WaitGroup
+	offloadFailures uint64
+
+	// snapshotMu guards the snapshot waiting to be written in the background, if any,
+	// and whether one is being written.
+	snapshotMu      sync.Mutex
+	pendingSnapshot *stateSnapshot
+	snapshotting    bool
+	// snapshots is the writing of the snapshots, which the log waits for on close.
+	snapshots sync.WaitGroup
+
+	// commitMu guards the store waiting to be committed in the background, if any,
+	// and whether one is being committed.
+	commitMu      sync.Mutex
+	pendingCommit *store
+	committing    bool
+	// committed is closed, and replaced, once a store is committed, with commitErr
+	// the error it failed with, for the reads waiting on the records to be committed.
+	committed chan struct{}
+	commitErr error
+	// commits is the committing of the stores, which the log waits for on close.
+	commits sync.WaitGroup
+
+	// logStartOffset is the offset records are deleted below, which may be
+	// past the base offset of the first segment until the segment is removed.
+	logStartOffset uint64
+
+	// onIOError, if set, is told of the I/O errors of the segments' files the appends,
+	// reads and background commits fail with. It may be called with the lock held.
+	onIOError func(error)
+
+	// recovery is what the log found in its directory when it was set up.
+	recovery Recovery
+
+	// lock keeps other logs from opening the directory while the log is open.
+	lock *dirLock
+
+	// roller rolls the aged segments in the background, once a max segment age is set.
+	roller *time.Ticker
+	closed bool
+	// closedErr is what the operations fail with once the log is closed.
+	closedErr error
+	close     chan struct{}
+	done      chan struct{}
+	// expirerDone is closed once the producers are no longer expired in the background.
+	expirerDone chan struct{}
+}
+
+// Stats describes the state of a log, as reported to the metrics.
+type Stats struct {
+	Segments                    int
+	Bytes                       uint64 // bytes of the stores and indexes on disk
+	LowestOffset, HighestOffset uint64
+	NextOffset                  uint64 // offset the next appended record gets
+	AppendedRecords             uint64 // records appended since the log was opened
+	AppendedBytes               uint64 // bytes appended to the stores since the log was opened
+	CacheBytes                  uint64 // bytes of the records in the read cache
+	CacheHits, CacheMisses      uint64 // reads served from the read cache, and not
+	OffloadFailures             uint64 // background offloads to the object store that failed
 }
 
 func NewLog(dir string, initialOffset, maxStoreBytes, maxIndexBytes uint64) (*Log, error) {
+	return NewEncryptedLog(dir, initialOffset, maxStoreBytes, maxIndexBytes, nil)
+}
+
+// NewEncryptedLog opens the log like NewLog, encrypting the records it appends
+// with the current key of the provider. The records appended unencrypted before
+// stay readable, as do the records encrypted with the provider's previous keys.
+// A nil provider encrypts nothing.
+func NewEncryptedLog(dir string, initialOffset, maxStoreBytes, maxIndexBytes uint64, keys KeyProvider) (*Log, error) {
 	if maxStoreBytes == 0 {
 		maxStoreBytes = 1024
 	}
@@ -33,100 +144,546 @@ func NewLog(dir string, initialOffset, maxStoreBytes, maxIndexBytes uint64) (*Lo
 		initialOffset: initialOffset,
 		maxStoreBytes: maxStoreBytes,
 		maxIndexBytes: maxIndexBytes,
+		close:         make(chan struct{}),
+		done:          make(chan struct{}),
+		expirerDone:   make(chan struct{}),
+		committed:     make(chan struct{}),
+	}
+	if keys != nil {
+		l.encryptor = newEncryptor(keys)
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.lock = lock
+
+	c, err := l.loadConfig()
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	// the segments are opened with the sizes they were written with.
+	if c != nil {
+		l.maxStoreBytes, l.maxIndexBytes = c.MaxStoreBytes, c.MaxIndexBytes
 	}
 
-	return l, l.setup()
+	if err := l.setup(); err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	go l.expireIdleProducers(producerExpirationInterval)
+	if c != nil {
+		if err := l.SetConfig(*c); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
 }
 
 func (l *Log) setup() error {
+	l.producers = make(map[uint64]*producerState)
+	l.openTransactions = make(map[uint64]uint64)
+	l.abortedTransactions = make(map[uint64]uint64)
+	l.keyOffsets = make(map[string]uint64)
+	l.prunedOffset = 0
+
 	files, err := os.ReadDir(l.dir)
 	if err != nil {
 		return err
 	}
 
-	if len(files) == 0 {
+	if err := l.loadLogStartOffset(); err != nil {
+		return err
+	}
+	if err := l.loadRemoteSegments(); err != nil {
+		return err
+	}
+
+	baseOffsets, rebuild, err := l.discoverSegments(files)
+	if err != nil {
+		return err
+	}
+	l.logRecovery()
+
+	if len(baseOffsets) == 0 {
 		// when the log is new and has no existing segments, bootstrap the initial segment.
 		return l.newSegment(l.initialOffset)
 	}
 
-	baseOffsets := make([]uint64, len(files))
-	for i, f := range files {
-		offStr := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets[i] = off
+	for _, baseOffset := range baseOffsets {
+		if err := l.newSegment(baseOffset); err != nil {
+			return err
+		}
+		if rebuild[baseOffset] {
+			if err := l.activeSegment.rebuildIndex(); err != nil {
+				return err
+			}
+		}
 	}
 
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+	return l.load()
+}
 
-	for i := 0; i < len(baseOffsets); i += 2 {
-		// baseOffset contains duplicate for store and index
-		if err := l.newSegment(baseOffsets[i]); err != nil {
-			return err
+// load rebuilds the state of the producers, transactions and keys from its latest snapshot
+// and the records in the segments past it.
+func (l *Log) load() error {
+	from, err := l.loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range l.segments {
+		if seg.baseOffset < from {
+			continue
+		}
+		for off := seg.baseOffset; off < seg.nextOffset; off++ {
+			record, err := seg.Read(off)
+			if err != nil {
+				return err
+			}
+			l.trackSequence(record, off)
+			l.trackTransaction(record, off)
+			l.trackKey(record, off)
+			if record.Timestamp > seg.maxTimestamp {
+				seg.maxTimestamp = record.Timestamp
+			}
 		}
 	}
+	// the records below the log start offset were deleted, though their segments are kept.
+	l.pruneState()
+	l.expireProducers(time.Now().UnixNano() / int64(time.Millisecond))
 
 	return nil
 }
 
+// pruneState forgets the state tracked for the records below the lowest offset,
+// once their segments are removed or the log start offset moves past them.
+func (l *Log) pruneState() {
+	lowest := l.lowestOffset()
+	if lowest <= l.prunedOffset {
+		return
+	}
+	l.prunedOffset = lowest
+
+	l.pruneKeys(lowest)
+	l.pruneProducers(lowest)
+	l.pruneTransactions(lowest)
+}
+
 func (l *Log) newSegment(off uint64) error {
+	// the rolled segment is committed, so that its records are all read without the lock.
+	if l.activeSegment != nil {
+		if err := l.activeSegment.store.Commit(); err != nil {
+			return err
+		}
+	}
+
 	seg, err := newSegment(l.dir, off, l.maxStoreBytes, l.maxIndexBytes)
 	if err != nil {
 		return err
 	}
+	seg.store.encryptor = l.encryptor
 
 	l.activeSegment = seg
 	l.segments = append(l.segments, seg)
 	return nil
 }
 
+// commitInBackground commits the active store without holding up the appends,
+// so that its records are read without the lock. It's called with the lock held.
+// The records appended while a store is committed are committed after it, together.
+func (l *Log) commitInBackground() {
+	l.commitMu.Lock()
+	defer l.commitMu.Unlock()
+
+	l.pendingCommit = l.activeSegment.store
+	if l.committing {
+		return
+	}
+	l.committing = true
+	l.commits.Add(1)
+	go l.commitStores()
+}
+
+// commitStores commits the pending stores until there are none left,
+// waking the reads waiting on their records.
+func (l *Log) commitStores() {
+	defer l.commits.Done()
+
+	for {
+		l.commitMu.Lock()
+		s := l.pendingCommit
+		l.pendingCommit = nil
+		if s == nil {
+			l.committing = false
+			l.commitMu.Unlock()
+			return
+		}
+		l.commitMu.Unlock()
+
+		err := s.Commit()
+		if err != nil {
+			zap.L().Named("log").Error("failed to commit the store", zap.String("dir", l.dir), zap.Error(err))
+			l.reportIOError(err)
+		}
+
+		l.commitMu.Lock()
+		l.commitErr = err
+		close(l.committed)
+		l.committed = make(chan struct{})
+		l.commitMu.Unlock()
+	}
+}
+
+// readRetrying runs the read with the lock held, and runs it again once what it
+// needs is there, without holding the lock meanwhile: the records it read past
+// once they're committed, rather than committing the store itself, or the remote
+// segment it read once it's fetched.
+func (l *Log) readRetrying(read func() error) error {
+	for {
+		l.commitMu.Lock()
+		committed, commitErr := l.committed, l.commitErr
+		l.commitMu.Unlock()
+
+		l.mu.RLock()
+		err := l.checkOpen()
+		if err == nil {
+			err = read()
+		}
+		l.mu.RUnlock()
+
+		var fetch *fetchNeeded
+		switch {
+		case errors.As(err, &fetch):
+			if err := l.fetch(fetch); err != nil {
+				return err
+			}
+		case errors.Is(err, errUncommitted):
+			// the records are committed in the background since they were appended,
+			// unless the store failed to commit.
+			if commitErr != nil {
+				return commitErr
+			}
+			<-committed
+		default:
+			return err
+		}
+	}
+}
+
+// Append appends the record and returns its offset.
+// Records of idempotent producers that were already appended aren't appended again,
+// and the offset they were appended at is returned instead.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendIf(record, nil)
+}
+
+// AppendIf appends the record like Append, as long as the condition holds.
+// It returns api.ErrConditionFailed otherwise. A nil condition always holds.
+// If the record is appended, but the segment it filled fails to roll or the retention fails,
+// it returns the record's offset along with the error.
+func (l *Log) AppendIf(record *api.Record, condition *api.Condition) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
+	if err := l.checkOpen(); err != nil {
 		return 0, err
 	}
 
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	if record.ProducerId != 0 {
+		off, duplicate, err := l.checkSequence(record)
+		if err != nil {
+			return 0, err
+		}
+		if duplicate {
+			return off, nil
+		}
+	}
+
+	if err := l.checkCondition(record, condition); err != nil {
+		return 0, err
+	}
+
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	size := l.activeSegment.store.size
+	off, p, err := l.activeSegment.appendEncoded(record)
+	if err != nil {
+		return 0, l.reportIOError(err)
+	}
+	// tailing consumers are about to read the record.
+	l.cache.put(off, p)
+	l.commitInBackground()
+	l.appendedRecords++
+	l.appendedBytes += l.activeSegment.store.size - size
+	l.trackSequence(record, off)
+	l.trackTransaction(record, off)
+	l.trackKey(record, off)
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if l.activeSegment.IsMaxed() || l.activeSegment.IsAged(l.maxSegmentAge, now) {
+		if err := l.rollSegment(off + 1); err != nil {
+			return off, fmt.Errorf("appended record %d, but failed to roll the segment: %w", off, l.reportIOError(err))
+		}
+		// the upload would hold up the appends and reads.
+		l.offloadInBackground()
+		if err := l.enforceRetention(); err != nil {
+			return off, fmt.Errorf("appended record %d, but failed to enforce the retention: %w", off, err)
+		}
 	}
 
 	return off, nil
 }
 
-func (l *Log) Read(off uint64) (*api.Record, error) {
+// SegmentInfo describes a segment of the log.
+type SegmentInfo struct {
+	BaseOffset, NextOffset uint64
+	StoreBytes, IndexBytes uint64
+	Active                 bool
+	MaxTimestamp           int64
+	// Remote is set for the segments offloaded to the object store.
+	Remote bool
+}
+
+// Segments describes the segments of the log, oldest first.
+func (l *Log) Segments() []SegmentInfo {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *segment
+	infos := make([]SegmentInfo, 0, len(l.remoteSegments)+len(l.segments))
+	for _, rs := range l.remoteSegments {
+		infos = append(infos, SegmentInfo{
+			BaseOffset:   rs.BaseOffset,
+			NextOffset:   rs.NextOffset,
+			StoreBytes:   rs.StoreBytes,
+			IndexBytes:   rs.IndexBytes,
+			MaxTimestamp: rs.MaxTimestamp,
+			Remote:       true,
+		})
+	}
 	for _, seg := range l.segments {
-		if seg.baseOffset <= off && off <= seg.nextOffset {
-			s = seg
-			break
+		infos = append(infos, SegmentInfo{
+			BaseOffset:   seg.baseOffset,
+			NextOffset:   seg.nextOffset,
+			StoreBytes:   seg.storeBytes(),
+			IndexBytes:   seg.index.size,
+			Active:       seg == l.activeSegment,
+			MaxTimestamp: seg.maxTimestamp,
+		})
+	}
+	return infos
+}
+
+// Roll starts a new active segment and returns its base offset.
+// It doesn't if the active segment is still empty.
+// The segments past the local retention are offloaded before it returns.
+func (l *Log) Roll() (uint64, error) {
+	off, err := l.rollActive()
+	if err != nil {
+		return 0, err
+	}
+	return off, l.offloadSegments()
+}
+
+func (l *Log) rollActive() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return l.activeSegment.baseOffset, nil
+	}
+
+	if err := l.rollSegment(l.activeSegment.nextOffset); err != nil {
+		return 0, err
+	}
+	return l.activeSegment.baseOffset, l.enforceRetention()
+}
+
+func (l *Log) Read(off uint64) (record *api.Record, err error) {
+	err = l.readRetrying(func() error {
+		record, err = l.read(off)
+		return err
+	})
+	return record, err
+}
+
+func (l *Log) read(off uint64) (*api.Record, error) {
+	p, err := l.readEncoded(off)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// readEncoded returns the encoded record at the offset, from the cache if it's there.
+// The record must not be modified.
+func (l *Log) readEncoded(off uint64) ([]byte, error) {
+	if off >= l.lowestOffset() && off < l.activeSegment.nextOffset {
+		if p, ok := l.cache.get(off); ok {
+			return p, nil
 		}
 	}
 
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	p, err := l.readSegment(nil, off)
+	if err != nil {
+		return nil, err
+	}
+	l.cache.put(off, p)
+
+	return p, nil
+}
+
+// ReadEncoded appends the record at the offset to dst as it's encoded in the store,
+// the protobuf encoding of an api.Record, sparing the reads that only pass it on
+// the decoding and encoding.
+func (l *Log) ReadEncoded(dst []byte, off uint64) (p []byte, err error) {
+	err = l.readRetrying(func() error {
+		if l.cache == nil {
+			p, err = l.readSegment(dst, off)
+			return err
+		}
+
+		p, err = l.readEncoded(off)
+		if err != nil {
+			return err
+		}
+		p = append(dst, p...)
+		return nil
+	})
+	return p, err
+}
+
+// readSegment appends the record at the offset to dst, read from its segment,
+// which is fetched from the object store if it's remote.
+func (l *Log) readSegment(dst []byte, off uint64) ([]byte, error) {
+	if off < l.segments[0].baseOffset && off >= l.logStartOffset {
+		if rs, ok := l.remoteSegment(off); ok {
+			return l.readRemote(dst, rs, off)
+		}
 	}
 
-	return s.Read(off)
+	s, err := l.segment(off)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.ReadEncoded(dst, off)
+	return p, l.reportIOError(err)
 }
 
+// reportIOError tells onIOError of the error if it's an I/O error, and returns it.
+func (l *Log) reportIOError(err error) error {
+	var pathErr *os.PathError
+	var errno syscall.Errno
+	if l.onIOError != nil && (errors.As(err, &pathErr) || errors.As(err, &errno)) {
+		l.onIOError(err)
+	}
+	return err
+}
+
+// segment returns the local segment holding the offset.
+func (l *Log) segment(off uint64) (*segment, error) {
+	var s *segment
+	if off >= l.activeSegment.baseOffset {
+		// most reads are of the latest records.
+		s = l.activeSegment
+	} else {
+		// the segments are sorted by their base offsets, so finds the last one at or below the offset.
+		i := sort.Search(len(l.segments), func(i int) bool {
+			return l.segments[i].baseOffset > off
+		})
+		if i > 0 {
+			s = l.segments[i-1]
+		}
+	}
+
+	if s == nil || s.nextOffset <= off || off < l.logStartOffset {
+		return nil, api.ErrOffsetOutOfRange{
+			Offset: off,
+			Lowest: l.lowestOffset(),
+			Next:   l.segments[len(l.segments)-1].nextOffset,
+		}
+	}
+
+	return s, nil
+}
+
+// ErrClosed is returned by the operations on a log that's been closed.
+var ErrClosed = errors.New("log is closed")
+
+// checkOpen returns the error the operations fail with once the log is closed.
+// It's called with the lock held.
+func (l *Log) checkOpen() error {
+	if l.closed {
+		return l.closedErr
+	}
+	return nil
+}
+
+// Close closes the segments, and stops rolling the aged segments in the background.
+// The operations on the log fail with ErrClosed from then on.
 func (l *Log) Close() error {
+	return l.closeWith(ErrClosed)
+}
+
+// closeWith closes the log, which the operations then fail with the error.
+func (l *Log) closeWith(err error) error {
+	l.mu.Lock()
+	rolling := l.roller != nil && !l.closed
+	if !l.closed {
+		l.closed, l.closedErr = true, err
+		close(l.close)
+	}
+	l.mu.Unlock()
+	if rolling {
+		// the roller takes the lock, so it's waited for without it.
+		<-l.done
+	}
+	// so does the producers' expirer.
+	<-l.expirerDone
+	// so do the offloads.
+	l.offloads.Wait()
+	// the snapshots taken before the log was closed are still written.
+	l.snapshots.Wait()
+	l.commits.Wait()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// every file is closed, and the lock released, even if one fails to close.
+	closeErr := l.closeSegments()
+	if err := l.closeFetched(); closeErr == nil {
+		closeErr = err
+	}
+	if err := l.lock.unlock(); closeErr == nil {
+		closeErr = err
+	}
+
+	return closeErr
+}
+
+// closeSegments closes every segment, returning the first error.
+func (l *Log) closeSegments() error {
+	var closeErr error
 	for _, seg := range l.segments {
-		if err := seg.Close(); err != nil {
-			return err
+		if err := seg.Close(); err != nil && closeErr == nil {
+			closeErr = err
 		}
 	}
-
-	return nil
+	return closeErr
 }
 
 func (l *Log) Remove() error {
@@ -137,22 +694,65 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.dir)
 }
 
+// Reset removes every record and starts the log over from its initial offset.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if err := l.closeSegments(); err != nil {
+		return err
+	}
+	for len(l.remoteSegments) > 0 {
+		if err := l.removeRemote(); err != nil {
+			return err
+		}
+	}
+	if err := l.closeFetched(); err != nil {
+		return err
+	}
+	// a snapshot written afterwards would be of the records removed.
+	l.waitSnapshots()
+	// the directory is emptied rather than removed, so that the log keeps its lock,
+	// and its configuration.
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
 		return err
 	}
+	for _, f := range files {
+		if f.Name() == lockFile || f.Name() == configFile {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(l.dir, f.Name())); err != nil {
+			return err
+		}
+	}
 
+	l.segments, l.activeSegment = nil, nil
+	l.cache.clear()
 	return l.setup()
 }
 
-// Truncate removes all segments whose highest offset is lower than `lowest`.
+// Truncate removes all segments whose highest offset is lower than `lowest`,
+// including the remote ones. The active segment is never removed.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	for len(l.remoteSegments) > 0 && l.remoteSegments[0].NextOffset-1 <= lowest {
+		if err := l.removeRemote(); err != nil {
+			return err
+		}
+	}
+
 	var segments []*segment
 	for _, seg := range l.segments {
-		if latestOffset := seg.nextOffset - 1; latestOffset <= lowest {
+		if latestOffset := seg.nextOffset - 1; seg != l.activeSegment && latestOffset <= lowest {
 			if err := seg.Remove(); err != nil {
 				return err
 			}
@@ -162,22 +762,41 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 
 	l.segments = segments
+	l.cache.removeBelow(l.lowestOffset())
+	l.pruneState()
 
 	return nil
 }
 
+// Reader reads the records of the local segments as they're framed in the stores,
+// each one preceded by its length, with the encrypted records decrypted.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	// the records appended so far are read to the end, as they're committed.
+	if err := l.activeSegment.store.Commit(); err != nil {
+		return &errReader{err: l.reportIOError(err)}
+	}
 	readers := make([]io.Reader, len(l.segments))
 	for i, seg := range l.segments {
-		readers[i] = &originReader{store: seg.store, off: 0}
+		readers[i] = &originReader{store: seg.store, off: headerBytes}
 	}
 	return io.MultiReader(readers...)
 }
 
 func (l *Log) LowerOffset() uint64 {
-	return l.segments[0].baseOffset
+	return l.lowestOffset()
+}
+
+func (l *Log) lowestOffset() uint64 {
+	base := l.segments[0].baseOffset
+	if len(l.remoteSegments) > 0 {
+		base = l.remoteSegments[0].BaseOffset
+	}
+	if base > l.logStartOffset {
+		return base
+	}
+	return l.logStartOffset
 }
 
 func (l *Log) HigherOffset() uint64 {
@@ -190,13 +809,120 @@ func (l *Log) HigherOffset() uint64 {
 	return off - 1
 }
 
+// Bounds returns the lowest offset in the log and the offset of the next record appended.
+func (l *Log) Bounds() (lowest, next uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.lowestOffset(), l.segments[len(l.segments)-1].nextOffset
+}
+
+// OffsetForTime returns the offset of the first record with a timestamp
+// at or after the timestamp, in milliseconds since the Unix epoch.
+// It skips the segments whose records are all older, and fetches the remote
+// segments it doesn't skip.
+func (l *Log) OffsetForTime(timestamp int64) (off uint64, ok bool, err error) {
+	err = l.readRetrying(func() error {
+		off, ok = 0, false
+		for _, rs := range l.remoteSegments {
+			if rs.MaxTimestamp < timestamp {
+				continue
+			}
+			if off, ok, err = l.remoteOffsetForTime(rs, timestamp); ok || err != nil {
+				return err
+			}
+		}
+
+		for _, seg := range l.segments {
+			if seg.maxTimestamp < timestamp {
+				continue
+			}
+			if off, ok, err = l.offsetForTime(seg, timestamp); ok || err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return off, ok, err
+}
+
+func (l *Log) offsetForTime(seg *segment, timestamp int64) (uint64, bool, error) {
+	for off := seg.baseOffset; off < seg.nextOffset; off++ {
+		if off < l.logStartOffset {
+			continue
+		}
+		record, err := seg.Read(off)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= timestamp {
+			return off, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{
+		Segments:        len(l.segments),
+		AppendedRecords: l.appendedRecords,
+		AppendedBytes:   l.appendedBytes,
+		OffloadFailures: l.offloadFailures,
+	}
+	stats.CacheBytes, stats.CacheHits, stats.CacheMisses = l.cache.stats()
+	for _, seg := range l.segments {
+		stats.Bytes += seg.size()
+	}
+	if len(l.segments) > 0 {
+		stats.LowestOffset = l.LowerOffset()
+		stats.HighestOffset = l.HigherOffset()
+		stats.NextOffset = l.segments[len(l.segments)-1].nextOffset
+	}
+
+	return stats
+}
+
+// errReader fails the reads with its error.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
 type originReader struct {
 	store *store
 	off   int64
+	// frame is the rest of the frame of the record last read.
+	frame []byte
 }
 
 func (r *originReader) Read(p []byte) (n int, err error) {
-	n, err = r.store.ReadAt(p, r.off)
-	r.off += int64(n)
-	return
+	if len(r.frame) == 0 {
+		var size [recordLengthBytes]byte
+		if _, err := r.store.ReadAt(size[:], r.off); err == errUncommitted {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		record, err := r.store.Read(uint64(r.off))
+		if err != nil {
+			return 0, err
+		}
+
+		r.frame = make([]byte, recordLengthBytes, recordLengthBytes+len(record))
+		enc.PutUint64(r.frame, uint64(len(record)))
+		r.frame = append(r.frame, record...)
+		r.off += recordLengthBytes + int64(enc.Uint64(size[:])&^encryptedFrame)
+	}
+
+	n = copy(p, r.frame)
+	r.frame = r.frame[n:]
+	return n, nil
 }
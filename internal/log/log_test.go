@@ -1,9 +1,15 @@
 package log
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -19,6 +25,26 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testLog_InitExisting,
 		"reader":                            testLog_Reader,
 		"truncate":                          testLog_Truncate,
+		"stats":                             testLog_Stats,
+		"read across segments":              testLog_ReadAcrossSegments,
+		"idempotent producer":               testLog_IdempotentProducer,
+		"state snapshot":                    testLog_StateSnapshot,
+		"read committed":                    testLog_ReadCommitted,
+		"conditional append":                testLog_AppendIf,
+		"offset for time":                   testLog_OffsetForTime,
+		"roll and retention":                testLog_RollRetention,
+		"reset":                             testLog_Reset,
+		"reopen with its config":            testLog_ReopenConfig,
+		"delete records":                    testLog_DeleteRecords,
+		"roll aged segments":                testLog_RollAged,
+		"read cache":                        testLog_ReadCache,
+		"tiered storage":                    testLog_TieredStorage,
+		"tiered storage failures":           testLog_TieredStorageFailures,
+		"tiered storage retention time":     testLog_TieredStorageRetentionTime,
+		"directory lock":                    testLog_Lock,
+		"close after a failure":             testLog_CloseFailure,
+		"failed roll":                       testLog_FailedRoll,
+		"recovery":                          testLog_Recovery,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "log-test")
@@ -33,6 +59,61 @@ func TestLog(t *testing.T) {
 	}
 }
 
+// BenchmarkLog_Read reads the records of logs with more and more segments,
+// which shouldn't make the reads slower.
+func BenchmarkLog_Read(b *testing.B) {
+	for _, segments := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			l, err := NewLog(dir, 0, 1024, 1024)
+			require.NoError(b, err)
+			defer l.Close()
+
+			// a record in each segment but the active one, which is read through the fast path.
+			for i := 0; i < segments; i++ {
+				_, err := l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(b, err)
+				_, err = l.Roll()
+				require.NoError(b, err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Read(uint64(i % segments)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLog_Append appends records to a log large enough to never roll.
+func BenchmarkLog_Append(b *testing.B) {
+	for _, size := range []int{64, 1024} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			l, err := NewLog(dir, 0, 1<<40, uint64(b.N+1)*indexEntireWidth)
+			require.NoError(b, err)
+			defer l.Close()
+
+			value := make([]byte, size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Append(&api.Record{Value: value}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func testLog_AppendRead(t *testing.T, l *Log) {
 	in := &api.Record{Value: []byte("hello world")}
 	off, err := l.Append(in)
@@ -104,3 +185,814 @@ func testLog_Truncate(t *testing.T, l *Log) {
 	_, err = l.Read(0)
 	require.Error(t, err)
 }
+
+func testLog_Stats(t *testing.T, l *Log) {
+	in := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(in)
+		require.NoError(t, err)
+	}
+
+	stats := l.Stats()
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, uint64(0), stats.LowestOffset)
+	require.Equal(t, uint64(2), stats.HighestOffset)
+	require.Equal(t, uint64(3), stats.AppendedRecords)
+	require.NotZero(t, stats.AppendedBytes)
+	require.Equal(t, stats.AppendedBytes+3*indexEntireWidth, stats.Bytes)
+}
+
+func testLog_ReadAcrossSegments(t *testing.T, l *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(l.segments), 1)
+
+	for off := uint64(0); off < 5; off++ {
+		out, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, out.Offset)
+	}
+
+	_, err := l.Read(5)
+	apiErr := err.(api.ErrOffsetOutOfRange)
+	require.Equal(t, uint64(0), apiErr.Lowest)
+	require.Equal(t, uint64(5), apiErr.Next)
+}
+
+func testLog_IdempotentProducer(t *testing.T, l *Log) {
+	id, err := l.InitProducer()
+	require.NoError(t, err)
+	other, err := l.InitProducer()
+	require.NoError(t, err)
+	require.NotEqual(t, id, other)
+
+	for i := uint64(0); i < 3; i++ {
+		off, err := l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: i})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world"), ProducerId: other, Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// a retried record gets its original offset back.
+	off, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(4), l.Stats().NextOffset)
+
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 5})
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Sequence: 5, Expected: 3}, err)
+
+	// the sequences are rebuilt from the records when the log is reopened.
+	require.NoError(t, l.Close())
+	defer func(interval time.Duration) {
+		producerExpirationInterval = interval
+	}(producerExpirationInterval)
+	producerExpirationInterval = 10 * time.Millisecond
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+
+	off, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	next, err := l.InitProducer()
+	require.NoError(t, err)
+	require.Greater(t, next, other)
+
+	// the producers are active as of when their records are appended,
+	// whatever the timestamps of the records.
+	old := time.Now().Add(-producerExpiration-time.Minute).UnixNano() / int64(time.Millisecond)
+	off, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: next, Sequence: 0, Timestamp: old})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	retried, err := l.Append(&api.Record{Value: []byte("hello world"), ProducerId: next, Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, off, retried)
+
+	// a producer idle for longer than the expiration is forgotten, without appends,
+	// so that its retries are taken for new records.
+	l.mu.Lock()
+	l.producers[next].lastActive = old
+	l.mu.Unlock()
+	require.Eventually(t, func() bool {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		_, ok := l.producers[next]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	retried, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: next, Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, off+1, retried)
+}
+
+func testLog_StateSnapshot(t *testing.T, l *Log) {
+	id, err := l.InitProducer()
+	require.NoError(t, err)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i := uint64(0); i < 3; i++ {
+		_, err := l.Append(&api.Record{Key: []byte("key"), Value: []byte("hello world"), ProducerId: id, Sequence: i, Timestamp: now + int64(i)})
+		require.NoError(t, err)
+	}
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), TransactionId: 1})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// the state is snapshotted as of the segment rolled to last.
+	b, err := os.ReadFile(path.Join(l.dir, stateSnapshotFile))
+	require.NoError(t, err)
+	var s stateSnapshot
+	require.NoError(t, json.Unmarshal(b, &s))
+	require.Equal(t, uint64(4), s.Offset)
+	require.Equal(t, now+1, s.MaxTimestamps[1])
+	require.Equal(t, map[uint64]uint64{1: 3}, s.OpenTransactions)
+
+	check := func(l *Log) {
+		off, err := l.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 1})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), off)
+		_, err = l.AppendIf(&api.Record{Key: []byte("key")}, &api.Condition{Expected: &api.Condition_KeyAbsent{KeyAbsent: true}})
+		require.Equal(t, api.ErrConditionFailed{NextOffset: 4, KeyOffset: 2, KeyFound: true}, err)
+		require.Equal(t, uint64(3), l.LastStableOffset())
+		require.Equal(t, now+1, l.Segments()[1].MaxTimestamp)
+	}
+
+	// the log is opened from the snapshot.
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	check(l)
+	require.NoError(t, l.Close())
+
+	// and from every record if the snapshot doesn't match the segments.
+	s.Offset = 100
+	b, err = json.Marshal(s)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(l.dir, stateSnapshotFile), b, 0644))
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	check(l)
+}
+
+func testLog_ReadCommitted(t *testing.T, l *Log) {
+	appendValue := func(value string, txn uint64) {
+		_, err := l.Append(&api.Record{Value: []byte(value), TransactionId: txn})
+		require.NoError(t, err)
+	}
+	appendValue("committed", 1)                                // 0
+	appendValue("aborted", 2)                                  // 1
+	appendValue("plain", 0)                                    // 2
+	require.NoError(t, l.EndTransaction(1, api.Record_COMMIT)) // 3
+	appendValue("open", 3)                                     // 4
+	require.NoError(t, l.EndTransaction(2, api.Record_ABORT))  // 5
+	appendValue("plain", 0)                                    // 6
+
+	// transactions without open records in the log don't get a control record.
+	require.NoError(t, l.EndTransaction(4, api.Record_COMMIT))
+	require.Equal(t, uint64(7), l.Stats().NextOffset)
+
+	readValues := func(l *Log) []string {
+		var values []string
+		for off := uint64(0); ; {
+			record, err := l.ReadCommitted(off)
+			if err != nil {
+				apiErr := err.(api.ErrOffsetOutOfRange)
+				require.Equal(t, l.LastStableOffset(), apiErr.Next)
+				return values
+			}
+			values = append(values, string(record.Value))
+			off = record.Offset + 1
+		}
+	}
+	require.Equal(t, uint64(4), l.LastStableOffset())
+	require.Equal(t, []string{"committed", "plain"}, readValues(l))
+
+	// the transactions are rebuilt from the records when the log is reopened.
+	require.NoError(t, l.Close())
+	l, err := NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(4), l.LastStableOffset())
+
+	require.NoError(t, l.EndTransaction(3, api.Record_COMMIT))
+	require.Equal(t, []string{"committed", "plain", "open", "plain"}, readValues(l))
+
+	// aborted transactions are forgotten once their control record is deleted.
+	_, err = l.DeleteRecords(5)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]uint64{2: 5}, l.abortedTransactions)
+	_, err = l.DeleteRecords(6)
+	require.NoError(t, err)
+	require.Empty(t, l.abortedTransactions)
+}
+
+func testLog_AppendIf(t *testing.T, l *Log) {
+	nextOffset := func(off uint64) *api.Condition {
+		return &api.Condition{Expected: &api.Condition_NextOffset{NextOffset: off}}
+	}
+	keyOffset := func(off uint64) *api.Condition {
+		return &api.Condition{Expected: &api.Condition_KeyOffset{KeyOffset: off}}
+	}
+	keyAbsent := &api.Condition{Expected: &api.Condition_KeyAbsent{KeyAbsent: true}}
+	record := func(key string) *api.Record {
+		return &api.Record{Key: []byte(key), Value: []byte("hello world")}
+	}
+
+	off, err := l.AppendIf(record("a"), nextOffset(0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, err = l.AppendIf(record("a"), nextOffset(0))
+	require.Equal(t, api.ErrConditionFailed{NextOffset: 1, KeyOffset: 0, KeyFound: true}, err)
+
+	_, err = l.AppendIf(record("a"), keyAbsent)
+	require.Equal(t, api.ErrConditionFailed{NextOffset: 1, KeyOffset: 0, KeyFound: true}, err)
+	off, err = l.AppendIf(record("b"), keyAbsent)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// another key moving on doesn't fail the condition on the key.
+	off, err = l.AppendIf(record("a"), keyOffset(0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = l.AppendIf(record("b"), keyOffset(0))
+	require.Equal(t, api.ErrConditionFailed{NextOffset: 3, KeyOffset: 1, KeyFound: true}, err)
+
+	// the keys are rebuilt from the records when the log is reopened.
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err = l.AppendIf(record("a"), keyOffset(2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// the keys whose last records were truncated are absent again.
+	require.NoError(t, l.Truncate(1))
+	off, err = l.AppendIf(record("b"), keyAbsent)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// so are the keys whose last records were deleted, even once the log is reopened.
+	_, err = l.DeleteRecords(5)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err = l.AppendIf(record("a"), keyAbsent)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func testLog_OffsetForTime(t *testing.T, l *Log) {
+	for _, ts := range []int64{10, 20, 20, 30} {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.NotZero(t, record.Timestamp, "the append time is set")
+
+	for ts, want := range map[int64]uint64{0: 0, 10: 0, 15: 1, 20: 1, 25: 3, 31: 4} {
+		off, ok, err := l.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, off, "timestamp %d", ts)
+	}
+	_, ok, err := l.OffsetForTime(record.Timestamp + 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	lowest, next := l.Bounds()
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(5), next)
+
+	// the timestamps of the segments are rebuilt when the log is reopened.
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	off, ok, err = l.OffsetForTime(25)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), off)
+}
+
+func testLog_RollRetention(t *testing.T, l *Log) {
+	off, err := l.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off, "an empty active segment isn't rolled")
+
+	config := l.Config()
+	config.CacheBytes = 1024
+	require.NoError(t, l.SetConfig(config))
+	for i := int64(0); i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello"), Timestamp: 1000 + i})
+		require.NoError(t, err)
+		_, err = l.Roll()
+		require.NoError(t, err)
+	}
+	cached := l.Stats().CacheBytes
+	segments := l.Segments()
+	require.Len(t, segments, 4)
+	require.Equal(t, SegmentInfo{
+		BaseOffset:   1,
+		NextOffset:   2,
+		StoreBytes:   segments[1].StoreBytes,
+		IndexBytes:   indexEntireWidth,
+		MaxTimestamp: 1001,
+	}, segments[1])
+	require.True(t, segments[3].Active)
+
+	// keeps the newest segments within the retention bytes.
+	config.RetentionBytes = segments[1].StoreBytes + segments[1].IndexBytes + segments[2].StoreBytes + segments[2].IndexBytes
+	require.NoError(t, l.SetConfig(config))
+	require.Equal(t, uint64(1), l.LowerOffset())
+	// the removed records are dropped from the cache.
+	cacheBytes := l.Stats().CacheBytes
+	require.Less(t, cacheBytes, cached)
+
+	// every record is past the retention time, but the active segment is kept.
+	config.RetentionBytes = 0
+	config.RetentionTime = time.Hour
+	require.NoError(t, l.SetConfig(config))
+	require.Len(t, l.Segments(), 1)
+	require.Equal(t, uint64(3), l.LowerOffset())
+	require.Less(t, l.Stats().CacheBytes, cacheBytes)
+}
+
+func testLog_Reset(t *testing.T, l *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, l.Reset())
+	require.Len(t, l.Segments(), 1)
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testLog_ReopenConfig(t *testing.T, l *Log) {
+	require.NoError(t, l.SetConfig(Config{MaxStoreBytes: 1 << 20, MaxIndexBytes: 1 << 16}))
+	for i := 0; i < 200; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// the segments are opened with the sizes they were written with, not the defaults.
+	l, err := NewLog(l.dir, 0, 0, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(1<<16), l.Config().MaxIndexBytes)
+	for off := uint64(0); off < 200; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), off)
+}
+
+func testLog_DeleteRecords(t *testing.T, l *Log) {
+	for i := 0; i < 2; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	_, err := l.Roll()
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+
+	// deletes the first record, in the middle of the first segment.
+	off, err := l.DeleteRecords(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = l.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0, Lowest: 1, Next: 3}, err)
+	_, err = l.Read(1)
+	require.NoError(t, err)
+	require.Len(t, l.Segments(), 2)
+
+	// the log start offset never moves back, nor past the next offset.
+	off, err = l.DeleteRecords(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = l.DeleteRecords(100)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// the checkpoint survives a restart, and isn't taken for a segment.
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	lowest, next := l.Bounds()
+	require.Equal(t, uint64(3), lowest)
+	require.Equal(t, uint64(3), next)
+
+	// the fully deleted segments are removed on the next roll.
+	require.Len(t, l.Segments(), 2)
+	_, err = l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	_, err = l.Roll()
+	require.NoError(t, err)
+	segments := l.Segments()
+	require.Len(t, segments, 2)
+	require.Equal(t, uint64(2), segments[0].BaseOffset)
+}
+
+func testLog_RollAged(t *testing.T, l *Log) {
+	defer l.Close()
+	require.NoError(t, l.SetConfig(Config{MaxSegmentAge: time.Hour}))
+
+	// a segment created longer than the age ago is rolled on the next append.
+	l.mu.Lock()
+	l.activeSegment.createdAt = time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	l.mu.Unlock()
+	_, err := l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.Len(t, l.Segments(), 2)
+
+	_, err = l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.NoError(t, l.rollAged())
+	require.Len(t, l.Segments(), 2)
+
+	// the active segment is rolled in the background, without appends.
+	require.NoError(t, l.SetConfig(Config{MaxSegmentAge: 20 * time.Millisecond}))
+	require.Eventually(t, func() bool {
+		return len(l.Segments()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// the empty active segment isn't rolled again.
+	time.Sleep(50 * time.Millisecond)
+	segments := l.Segments()
+	require.Len(t, segments, 3)
+	require.Equal(t, uint64(2), segments[2].BaseOffset)
+	require.True(t, segments[2].Active)
+}
+
+func testLog_ReadCache(t *testing.T, l *Log) {
+	require.NoError(t, l.SetConfig(Config{MaxStoreBytes: 1024, CacheBytes: 1024}))
+
+	// appended records are cached for the tailing consumers.
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	read, err := l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	stats := l.Stats()
+	require.Equal(t, uint64(1), stats.CacheHits)
+	require.NotZero(t, stats.CacheBytes)
+
+	// the cached records are decoded anew for each read.
+	read.Value[0] = 'j'
+	read, err = l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	encoded, err := l.ReadEncoded(nil, 1)
+	require.NoError(t, err)
+	require.NoError(t, proto.Unmarshal(encoded, read))
+	require.Equal(t, uint64(1), read.Offset)
+	require.Equal(t, uint64(3), l.Stats().CacheHits)
+
+	// the records reused by a reset aren't read from the cache.
+	require.NoError(t, l.Reset())
+	_, err = l.Read(0)
+	require.Error(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	read, err = l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), read.Value)
+
+	require.NoError(t, l.SetConfig(Config{MaxStoreBytes: 1024}))
+	require.Zero(t, l.Stats().CacheBytes)
+}
+
+func testLog_TieredStorage(t *testing.T, l *Log) {
+	dir, err := os.MkdirTemp("", "object-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalObjectStore(dir)
+	require.NoError(t, err)
+
+	// offloads every segment but the active one.
+	require.NoError(t, l.SetConfig(Config{LocalRetentionBytes: 1}))
+	require.NoError(t, l.SetObjectStore(store, "test/"))
+	for i := int64(1); i <= 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Timestamp: i * 1000})
+		require.NoError(t, err)
+		_, err = l.Roll()
+		require.NoError(t, err)
+	}
+
+	segments := l.Segments()
+	require.Len(t, segments, 4)
+	for _, seg := range segments[:3] {
+		require.True(t, seg.Remote)
+	}
+	require.True(t, segments[3].Active)
+	require.Equal(t, uint64(0), l.LowerOffset())
+
+	for off := uint64(0); off < 3; off++ {
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+		require.Equal(t, off, read.Offset)
+	}
+	off, ok, err := l.OffsetForTime(1500)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+
+	// the remote segments are remembered across restarts,
+	// though they can't be read until the object store is set again.
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Len(t, l.Segments(), 4)
+	_, err = l.Read(0)
+	require.Error(t, err)
+	require.NoError(t, l.SetObjectStore(store, "test/"))
+	_, err = l.Read(0)
+	require.NoError(t, err)
+
+	// truncating removes the remote segments from the object store.
+	require.NoError(t, l.Truncate(0))
+	_, err = l.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0, Lowest: 1, Next: 3}, err)
+	_, err = store.Get("test/0.store")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, l.Reset())
+	require.Len(t, l.Segments(), 1)
+	_, err = store.Get("test/1.store")
+	require.True(t, os.IsNotExist(err))
+}
+
+func testLog_TieredStorageRetentionTime(t *testing.T, l *Log) {
+	dir, err := os.MkdirTemp("", "object-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalObjectStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, l.SetConfig(Config{LocalRetentionTime: time.Hour}))
+	require.NoError(t, l.SetObjectStore(store, "test/"))
+
+	// the records' timestamps are set by the clients, so they don't age the segments.
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: 1000})
+	require.NoError(t, err)
+	_, err = l.Roll()
+	require.NoError(t, err)
+	require.False(t, l.Segments()[0].Remote)
+
+	// the segments created longer ago than the local retention are offloaded.
+	l.mu.Lock()
+	l.segments[0].createdAt -= int64(2 * time.Hour / time.Millisecond)
+	l.mu.Unlock()
+	require.NoError(t, l.EnforceRetention())
+	require.True(t, l.Segments()[0].Remote)
+}
+
+// flakyObjectStore fails the puts while it's failing, and holds them until it's released
+// while it's held. It holds the gets likewise while getHeld is set.
+type flakyObjectStore struct {
+	ObjectStore
+
+	mu         sync.Mutex
+	failing    bool
+	held       chan struct{}
+	started    chan struct{}
+	getHeld    chan struct{}
+	getStarted chan struct{}
+}
+
+func (s *flakyObjectStore) Get(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	held, started := s.getHeld, s.getStarted
+	s.mu.Unlock()
+
+	if held != nil {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-held
+	}
+	return s.ObjectStore.Get(name)
+}
+
+func (s *flakyObjectStore) Put(name string, r io.Reader) error {
+	s.mu.Lock()
+	failing, held, started := s.failing, s.held, s.started
+	s.mu.Unlock()
+
+	if failing {
+		return errors.New("object store unavailable")
+	}
+	if held != nil {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-held
+	}
+	return s.ObjectStore.Put(name, r)
+}
+
+func testLog_TieredStorageFailures(t *testing.T, l *Log) {
+	dir, err := os.MkdirTemp("", "object-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local, err := NewLocalObjectStore(dir)
+	require.NoError(t, err)
+	store := &flakyObjectStore{ObjectStore: local, failing: true}
+
+	require.NoError(t, l.SetConfig(Config{MaxStoreBytes: l.maxStoreBytes, LocalRetentionBytes: 1}))
+	require.NoError(t, l.SetObjectStore(store, "test/"))
+
+	// the segments that fail to upload stay local, and readable.
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = l.Roll()
+	require.Error(t, err)
+	// the appends that roll a segment offload in the background.
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	l.offloads.Wait()
+	require.NotZero(t, l.Stats().OffloadFailures)
+	for _, seg := range l.Segments() {
+		require.False(t, seg.Remote)
+	}
+	for off := uint64(0); off < 3; off++ {
+		_, err := l.Read(off)
+		require.NoError(t, err)
+	}
+
+	// the appends and reads go on while a segment uploads.
+	store.mu.Lock()
+	store.failing = false
+	store.held, store.started = make(chan struct{}), make(chan struct{}, 1)
+	store.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	<-store.started
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = l.Read(off)
+	require.NoError(t, err)
+	require.False(t, l.Segments()[0].Remote)
+
+	close(store.held)
+	l.offloads.Wait()
+	require.NoError(t, l.EnforceRetention())
+	segments := l.Segments()
+	for _, seg := range segments[:len(segments)-1] {
+		require.True(t, seg.Remote)
+	}
+	for off := uint64(0); off < 6; off++ {
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	// the appends go on while a remote segment is fetched for a read.
+	require.NoError(t, l.closeFetched())
+	store.mu.Lock()
+	store.getHeld, store.getStarted = make(chan struct{}), make(chan struct{}, 1)
+	store.mu.Unlock()
+	read := make(chan error)
+	go func() {
+		_, err := l.Read(0)
+		read <- err
+	}()
+	<-store.getStarted
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	close(store.getHeld)
+	require.NoError(t, <-read)
+}
+
+func testLog_Lock(t *testing.T, l *Log) {
+	_, err := NewLog(l.dir, 0, 0, 0)
+	require.ErrorIs(t, err, ErrLocked)
+	require.Contains(t, err.Error(), fmt.Sprintf("process %d", os.Getpid()))
+
+	// the log keeps its lock through a reset.
+	require.NoError(t, l.Reset())
+	_, err = NewLog(l.dir, 0, 0, 0)
+	require.ErrorIs(t, err, ErrLocked)
+
+	// the lock is released once the log is closed.
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.dir, 0, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Remove())
+}
+
+func testLog_CloseFailure(t *testing.T, l *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	segments := l.segments
+	require.Greater(t, len(segments), 1)
+
+	// the first segment fails to close, but the others are still closed.
+	require.NoError(t, segments[0].store.f.Close())
+	require.ErrorIs(t, l.Close(), os.ErrClosed)
+	for _, seg := range segments[1:] {
+		require.ErrorIs(t, seg.store.f.Close(), os.ErrClosed)
+	}
+
+	// and the lock is released.
+	l, err := NewLog(l.dir, 0, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Remove())
+}
+
+func testLog_Recovery(t *testing.T, l *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	segments := l.Segments()
+	require.Greater(t, len(segments), 2)
+	lost := segments[1].BaseOffset
+	require.Equal(t, Recovery{}, l.Recovery())
+	require.NoError(t, l.Close())
+
+	// loses an index, and leaves stray files beside the segments.
+	require.NoError(t, os.Remove(path.Join(l.dir, fmt.Sprintf("%d.index", lost))))
+	for _, name := range []string{"notes.txt", "007.store", "1000.index"} {
+		require.NoError(t, os.WriteFile(path.Join(l.dir, name), []byte("stray"), 0644))
+	}
+
+	l, err := NewLog(l.dir, l.initialOffset, l.maxStoreBytes, l.maxIndexBytes)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, Recovery{
+		Segments:        len(segments),
+		RebuiltIndexes:  []uint64{lost},
+		OrphanedIndexes: []uint64{1000},
+		Quarantined:     []string{"007.store", "1000.index", "notes.txt"},
+	}, l.Recovery())
+
+	for off := uint64(0); off < 5; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	for _, name := range []string{"notes.txt", "007.store", "1000.index"} {
+		_, err := os.Stat(path.Join(l.dir, quarantineDir, name))
+		require.NoError(t, err)
+	}
+}
+
+func testLog_FailedRoll(t *testing.T, l *Log) {
+	// the second record fills the segment, but the next one can't be created
+	// where a directory is in the way.
+	next := path.Join(l.dir, "2.store")
+	require.NoError(t, os.Mkdir(next, 0755))
+
+	in := &api.Record{Value: []byte("hello world")}
+	_, err := l.Append(in)
+	require.NoError(t, err)
+	off, err := l.Append(in)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to roll the segment")
+	require.Equal(t, uint64(1), off)
+	require.Len(t, l.Segments(), 1)
+
+	// the record was appended regardless, and the segment rolls once it can.
+	_, err = l.Read(off)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(next))
+	off, err = l.Append(in)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Len(t, l.Segments(), 2)
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sync"
+)
+
+// Offsets persists the offsets committed by consumer groups,
+// each being the offset of the next record the group consumes.
+//
+// The offsets are kept in a single file, rewritten atomically on every commit.
+// It must live outside of a log's directory, where every file is taken for a segment.
+type Offsets struct {
+	mu      sync.RWMutex
+	path    string
+	offsets map[string]uint64
+	// closedErr, once set, is what the commits fail with.
+	closedErr error
+}
+
+func NewOffsets(path string) (*Offsets, error) {
+	o := &Offsets{
+		path:    path,
+		offsets: map[string]uint64{},
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &o.offsets); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *Offsets) Commit(group string, offset uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closedErr != nil {
+		return o.closedErr
+	}
+	prev, ok := o.offsets[group]
+	o.offsets[group] = offset
+	if err := o.persist(); err != nil {
+		if ok {
+			o.offsets[group] = prev
+		} else {
+			delete(o.offsets, group)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Fetch returns the offset committed by the group, if any.
+func (o *Offsets) Fetch(group string) (uint64, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	off, ok := o.offsets[group]
+	return off, ok
+}
+
+// Groups returns the offsets committed by every group.
+func (o *Offsets) Groups() map[string]uint64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	groups := make(map[string]uint64, len(o.offsets))
+	for g, off := range o.offsets {
+		groups[g] = off
+	}
+	return groups
+}
+
+// Close stops the offsets from being committed, which fail with ErrClosed from then on.
+// The offsets already committed are persisted.
+func (o *Offsets) Close() error {
+	o.closeWith(ErrClosed)
+	return nil
+}
+
+// closeWith stops the offsets from being committed, which then fail with the error.
+func (o *Offsets) closeWith(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closedErr == nil {
+		o.closedErr = err
+	}
+}
+
+func (o *Offsets) persist() error {
+	b, err := json.Marshal(o.offsets)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(o.path, b)
+}
+
+// writeFileAtomic writes to a temporary file and renames it over the previous one,
+// so that a crash never leaves the file half written.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(path.Dir(name), path.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
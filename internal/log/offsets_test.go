@@ -0,0 +1,39 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o, err := NewOffsets(path.Join(dir, "offsets.json"))
+	require.NoError(t, err)
+
+	_, ok := o.Fetch("group")
+	require.False(t, ok)
+
+	require.NoError(t, o.Commit("group", 3))
+	require.NoError(t, o.Commit("other", 1))
+	require.NoError(t, o.Commit("group", 5))
+
+	off, ok := o.Fetch("group")
+	require.True(t, ok)
+	require.Equal(t, uint64(5), off)
+
+	// the offsets survive a restart
+	o, err = NewOffsets(path.Join(dir, "offsets.json"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"group": 5, "other": 1}, o.Groups())
+
+	// no temporary files are left behind
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+// producerWindow is how many of a producer's latest records are remembered,
+// so that retries of them get their original offsets back.
+// It needs to cover the records a producer may have in flight.
+const producerWindow = 1024
+
+// producerExpiration is how long a producer is remembered after its last record,
+// like Kafka's producer.id.expiration.ms. A producer coming back after it expired
+// is taken for a new one, so that the retries of its old records aren't suppressed.
+const producerExpiration = 24 * time.Hour
+
+// producerExpirationInterval is how often the idle producers are expired,
+// like Kafka's producer.id.expiration.check.interval.ms.
+var producerExpirationInterval = 10 * time.Minute
+
+// producerState tracks the records appended by an idempotent producer.
+type producerState struct {
+	lastSequence uint64
+	// offsets of the latest records of the producer, the last one being lastSequence's.
+	offsets []uint64
+	// lastActive is when the producer's last record was appended, in Unix milliseconds
+	// by the log's clock, rather than the record's timestamp, which comes from the client.
+	lastActive int64
+}
+
+func (p *producerState) append(sequence, offset uint64, now int64) {
+	p.lastSequence = sequence
+	p.lastActive = now
+	p.offsets = append(p.offsets, offset)
+	if len(p.offsets) > producerWindow {
+		p.offsets = p.offsets[len(p.offsets)-producerWindow:]
+	}
+}
+
+// offset returns the offset the record with the sequence was appended at,
+// if it's still in the window.
+func (p *producerState) offset(sequence uint64) (uint64, bool) {
+	back := p.lastSequence - sequence
+	if back >= uint64(len(p.offsets)) {
+		return 0, false
+	}
+	return p.offsets[uint64(len(p.offsets))-1-back], true
+}
+
+// InitProducer returns a new producer ID for an idempotent producer.
+//
+// IDs are taken from the clock, so they stay unique across restarts
+// without the log having to persist them.
+func (l *Log) InitProducer() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	id := uint64(time.Now().UnixNano())
+	if id <= l.lastProducerID {
+		id = l.lastProducerID + 1
+	}
+	l.lastProducerID = id
+
+	return id, nil
+}
+
+// checkSequence returns the original offset of the record if it's a duplicate
+// of one of its producer's recent records, or an error if its sequence is out of order.
+// The first record seen from a producer may have any sequence, since the records
+// it had appended before may have been truncated.
+func (l *Log) checkSequence(record *api.Record) (off uint64, duplicate bool, err error) {
+	p, ok := l.producers[record.ProducerId]
+	if !ok || record.Sequence == p.lastSequence+1 {
+		return 0, false, nil
+	}
+
+	if record.Sequence <= p.lastSequence {
+		if off, ok := p.offset(record.Sequence); ok {
+			return off, true, nil
+		}
+	}
+
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		Expected:   p.lastSequence + 1,
+	}
+}
+
+func (l *Log) trackSequence(record *api.Record, off uint64) {
+	if record.ProducerId == 0 {
+		return
+	}
+
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	// the producers replayed when the log is opened are taken as active as of then.
+	p.append(record.Sequence, off, time.Now().UnixNano()/int64(time.Millisecond))
+
+	if record.ProducerId > l.lastProducerID {
+		l.lastProducerID = record.ProducerId
+	}
+}
+
+// expireIdleProducers expires the producers in the background every interval until
+// the log is closed, since a log that isn't appended to would keep them otherwise.
+func (l *Log) expireIdleProducers(interval time.Duration) {
+	defer close(l.expirerDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.close:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			l.expireProducers(now.UnixNano() / int64(time.Millisecond))
+			l.mu.Unlock()
+		}
+	}
+}
+
+// expireProducers forgets the producers idle for longer than producerExpiration.
+func (l *Log) expireProducers(now int64) {
+	cutoff := now - int64(producerExpiration/time.Millisecond)
+	for id, p := range l.producers {
+		if p.lastActive < cutoff {
+			delete(l.producers, id)
+		}
+	}
+}
+
+// pruneProducers forgets the producers whose records are all below the offset.
+func (l *Log) pruneProducers(lowest uint64) {
+	for id, p := range l.producers {
+		if p.offsets[len(p.offsets)-1] < lowest {
+			delete(l.producers, id)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// quarantineDir is the directory in the log's directory the files the log doesn't know
+// are moved to, so that they're kept for an operator to look at without getting in the way.
+const quarantineDir = "quarantine"
+
+// Recovery summarizes what the log found in its directory when it was opened.
+type Recovery struct {
+	// Segments is how many segments were opened.
+	Segments int
+	// RebuiltIndexes are the base offsets of the segments whose index was missing,
+	// and was rebuilt from their store.
+	RebuiltIndexes []uint64
+	// OrphanedIndexes are the base offsets of the indexes without a store,
+	// which were quarantined.
+	OrphanedIndexes []uint64
+	// Quarantined are the names of the files moved to the quarantine directory.
+	Quarantined []string
+}
+
+// Recovery returns what the log found in its directory when it was last set up.
+func (l *Log) Recovery() Recovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.recovery
+}
+
+// segmentFiles tells which files of a segment are in the log's directory.
+type segmentFiles struct {
+	store, index bool
+}
+
+// discoverSegments groups the files in the log's directory by the segments they belong to,
+// and returns the base offsets of the segments to open, sorted, and whether their index
+// has to be rebuilt. The files that aren't the log's are quarantined, and so are
+// the indexes without a store, since there are no records for them to point to.
+func (l *Log) discoverSegments(files []os.DirEntry) ([]uint64, map[uint64]bool, error) {
+	l.recovery = Recovery{}
+
+	segments := map[uint64]*segmentFiles{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || isLogFile(name) {
+			continue
+		}
+
+		baseOffset, ext, ok := parseSegmentName(name)
+		if !ok {
+			if err := l.quarantine(name); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		seg, ok := segments[baseOffset]
+		if !ok {
+			seg = &segmentFiles{}
+			segments[baseOffset] = seg
+		}
+		if ext == ".store" {
+			seg.store = true
+		} else {
+			seg.index = true
+		}
+	}
+
+	var baseOffsets []uint64
+	rebuild := map[uint64]bool{}
+	for baseOffset, seg := range segments {
+		if !seg.store {
+			if err := l.quarantine(fmt.Sprintf("%d.index", baseOffset)); err != nil {
+				return nil, nil, err
+			}
+			l.recovery.OrphanedIndexes = append(l.recovery.OrphanedIndexes, baseOffset)
+			continue
+		}
+		if !seg.index {
+			rebuild[baseOffset] = true
+			l.recovery.RebuiltIndexes = append(l.recovery.RebuiltIndexes, baseOffset)
+		}
+		baseOffsets = append(baseOffsets, baseOffset)
+	}
+
+	for _, offsets := range [][]uint64{baseOffsets, l.recovery.RebuiltIndexes, l.recovery.OrphanedIndexes} {
+		sort.Slice(offsets, func(i, j int) bool {
+			return offsets[i] < offsets[j]
+		})
+	}
+	sort.Strings(l.recovery.Quarantined)
+	l.recovery.Segments = len(baseOffsets)
+
+	return baseOffsets, rebuild, nil
+}
+
+// isLogFile returns whether the file is one of the log's own files besides its segments.
+func isLogFile(name string) bool {
+	switch name {
+	case logStartOffsetFile, remoteSegmentsFile, lockFile, configFile, stateSnapshotFile:
+		return true
+	}
+	return false
+}
+
+// parseSegmentName parses the name of a store or index file, "<base offset>.store"
+// or "<base offset>.index".
+func parseSegmentName(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	if ext != ".store" && ext != ".index" {
+		return 0, "", false
+	}
+
+	offStr := strings.TrimSuffix(name, ext)
+	baseOffset, err := strconv.ParseUint(offStr, 10, 64)
+	// the names are written by the log, so anything but its formatting isn't its file.
+	if err != nil || strconv.FormatUint(baseOffset, 10) != offStr {
+		return 0, "", false
+	}
+	return baseOffset, ext, true
+}
+
+// quarantine moves the file to the quarantine directory, keeping the files already there.
+func (l *Log) quarantine(name string) error {
+	dir := path.Join(l.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	dst := path.Join(dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		dst = fmt.Sprintf("%s.%d", dst, time.Now().UnixNano())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(path.Join(l.dir, name), dst); err != nil {
+		return err
+	}
+
+	l.recovery.Quarantined = append(l.recovery.Quarantined, name)
+	return nil
+}
+
+// logRecovery logs what the log recovered from, if anything.
+func (l *Log) logRecovery() {
+	r := l.recovery
+	if len(r.RebuiltIndexes) == 0 && len(r.OrphanedIndexes) == 0 && len(r.Quarantined) == 0 {
+		return
+	}
+
+	zap.L().Named("log").Warn(
+		"recovered log",
+		zap.String("dir", l.dir),
+		zap.Int("segments", r.Segments),
+		zap.Uint64s("rebuilt_indexes", r.RebuiltIndexes),
+		zap.Uint64s("orphaned_indexes", r.OrphanedIndexes),
+		zap.Strings("quarantined", r.Quarantined),
+	)
+}
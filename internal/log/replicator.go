@@ -3,6 +3,7 @@ package log
 import (
 	"context"
 	"sync"
+	"time"
 
 	api "github.com/kazukousen/go-distributed/api/v1"
 	"go.uber.org/zap"
@@ -17,10 +18,39 @@ type Replicator struct {
 
 	mu      sync.Mutex
 	servers map[string]chan struct{}
+	peers   map[string]*PeerStats
 	closed  bool
 	close   chan struct{}
 }
 
+// PeerStats describes how far the records of a peer have been replicated.
+type PeerStats struct {
+	// Replicated is the number of records replicated from the peer.
+	Replicated uint64
+	// Offset is the offset in the peer's log of the last replicated record.
+	Offset uint64
+	// LastReplicated is when the last record was replicated.
+	LastReplicated time.Time
+	// HighWatermark is the offset of the next record appended to the peer's log,
+	// as last fetched from the peer.
+	HighWatermark uint64
+}
+
+// Lag returns the number of records in the peer's log yet to be replicated.
+func (s PeerStats) Lag() uint64 {
+	var next uint64
+	if s.Replicated > 0 {
+		next = s.Offset + 1
+	}
+	if s.HighWatermark <= next {
+		return 0
+	}
+	return s.HighWatermark - next
+}
+
+// replicatorOffsetsInterval is how often the replicator fetches the offsets of the peers.
+var replicatorOffsetsInterval = 5 * time.Second
+
 // Join adds the given server address to the list of servers to replicate
 // and kicks off the add goroutine to run the actual replication logic.
 func (r *Replicator) Join(name, addr string) error {
@@ -38,6 +68,7 @@ func (r *Replicator) Join(name, addr string) error {
 		return nil
 	}
 	r.servers[name] = make(chan struct{})
+	r.peers[name] = &PeerStats{}
 
 	return nil
 }
@@ -49,12 +80,15 @@ func (r *Replicator) init() {
 	if r.servers == nil {
 		r.servers = make(map[string]chan struct{})
 	}
+	if r.peers == nil {
+		r.peers = make(map[string]*PeerStats)
+	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
 }
 
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
+func (r *Replicator) replicate(name, addr string, leave chan struct{}) {
 	cc, err := grpc.Dial(addr, r.DialOptions...)
 	if err != nil {
 		r.logError(err, "failed to dial", addr)
@@ -85,6 +119,10 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 		}
 	}()
 
+	ticker := time.NewTicker(replicatorOffsetsInterval)
+	defer ticker.Stop()
+	r.fetchOffsets(ctx, client, name, addr)
+
 	// the loop consumes the logs from the discovered server in a stream
 	// and then produces to the local server to save a copy.
 	for {
@@ -93,7 +131,10 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 			return
 		case <-leave:
 			return
+		case <-ticker.C:
+			r.fetchOffsets(ctx, client, name, addr)
 		case record := <-records:
+			offset := record.Offset
 			_, err = r.LocalServer.Produce(ctx, &api.ProduceRequest{
 				Record: record,
 			})
@@ -101,10 +142,55 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 				r.logError(err, "failed to produce", addr)
 				return
 			}
+			r.replicated(name, offset)
 		}
 	}
 }
 
+// fetchOffsets records the high watermark of the peer, from which its lag is reported.
+func (r *Replicator) fetchOffsets(ctx context.Context, client api.LogClient, name, addr string) {
+	res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		r.logError(err, "failed to get offsets", addr)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if peer, ok := r.peers[name]; ok {
+		peer.HighWatermark = res.HighWatermark
+	}
+}
+
+func (r *Replicator) replicated(name string, offset uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok := r.peers[name]
+	if !ok {
+		return
+	}
+	peer.Replicated++
+	peer.Offset = offset
+	peer.LastReplicated = time.Now()
+	if peer.HighWatermark <= offset {
+		peer.HighWatermark = offset + 1
+	}
+}
+
+// Stats returns the replication stats of the peers being replicated, keyed by their names.
+func (r *Replicator) Stats() map[string]PeerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]PeerStats, len(r.peers))
+	for name, peer := range r.peers {
+		stats[name] = *peer
+	}
+	return stats
+}
+
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -117,6 +203,7 @@ func (r *Replicator) Leave(name string) error {
 
 	close(r.servers[name])
 	delete(r.servers, name)
+	delete(r.peers, name)
 	return nil
 }
 
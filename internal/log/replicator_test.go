@@ -0,0 +1,86 @@
+package log
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestReplicator_Stats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	api.RegisterLogServer(server, &peerServer{
+		records:       []*api.Record{{Offset: 0}, {Offset: 1}, {Offset: 2}},
+		highWatermark: 5,
+	})
+	go server.Serve(l)
+	defer server.Stop()
+
+	local := &localClient{produced: make(chan *api.Record, 3)}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LocalServer: local,
+	}
+	defer r.Close()
+	require.NoError(t, r.Join("peer", l.Addr().String()))
+	require.Equal(t, PeerStats{}, r.Stats()["peer"])
+
+	go r.replicate("peer", l.Addr().String(), r.servers["peer"])
+
+	for i := uint64(0); i < 3; i++ {
+		select {
+		case record := <-local.produced:
+			require.Equal(t, i, record.Offset)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the record wasn't replicated")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return r.Stats()["peer"].Replicated == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := r.Stats()["peer"]
+	require.Equal(t, uint64(2), stats.Offset)
+	require.Equal(t, uint64(5), stats.HighWatermark)
+	// the records at offsets 3 and 4 are yet to be replicated.
+	require.Equal(t, uint64(2), stats.Lag())
+}
+
+// peerServer streams the records to the replicator and reports its high watermark.
+type peerServer struct {
+	api.UnimplementedLogServer
+	records       []*api.Record
+	highWatermark uint64
+}
+
+func (s *peerServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	for _, record := range s.records {
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func (s *peerServer) GetOffsets(context.Context, *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	return &api.GetOffsetsResponse{HighWatermark: s.highWatermark}, nil
+}
+
+// localClient records the records the replicator produces to the local server.
+type localClient struct {
+	api.LogClient
+	produced chan *api.Record
+}
+
+func (c *localClient) Produce(_ context.Context, req *api.ProduceRequest, _ ...grpc.CallOption) (*api.ProduceResponse, error) {
+	c.produced <- req.Record
+	return &api.ProduceResponse{Offset: req.Record.Offset}, nil
+}
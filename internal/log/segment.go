@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -15,14 +16,23 @@ type segment struct {
 	index                        *index
 	baseOffset, nextOffset       uint64
 	maxStoreBytes, maxIndexBytes uint64
+	// maxTimestamp is the latest timestamp of the records in the segment.
+	maxTimestamp int64
+	// createdAt is when the segment was created, in Unix milliseconds, as recorded in its header.
+	// The age of the segment is measured from it.
+	createdAt int64
 }
 
 func newSegment(dir string, baseOffset uint64, maxStoreBytes, maxIndexBytes uint64) (*segment, error) {
+	if err := migrateSegment(dir, baseOffset); err != nil {
+		return nil, err
+	}
 
-	sf, err := os.OpenFile(
+	sf, h, err := openSegmentFile(
 		path.Join(dir, fmt.Sprintf("%d.store", baseOffset)),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
+		storeMagic,
+		baseOffset,
 	)
 	if err != nil {
 		return nil, err
@@ -33,17 +43,20 @@ func newSegment(dir string, baseOffset uint64, maxStoreBytes, maxIndexBytes uint
 		return nil, err
 	}
 
-	idxf, err := os.OpenFile(
+	idxf, _, err := openSegmentFile(
 		path.Join(dir, fmt.Sprintf("%d.index", baseOffset)),
 		os.O_RDWR|os.O_CREATE,
-		0644,
+		indexMagic,
+		baseOffset,
 	)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
 	idx, err := newIndex(idxf, int64(maxIndexBytes))
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
@@ -59,21 +72,28 @@ func newSegment(dir string, baseOffset uint64, maxStoreBytes, maxIndexBytes uint
 		nextOffset:    nextOffset,
 		maxStoreBytes: maxStoreBytes,
 		maxIndexBytes: maxIndexBytes,
+		createdAt:     h.createdAt,
 	}, nil
 }
 
 func (s *segment) Append(record *api.Record) (off uint64, err error) {
+	off, _, err = s.appendEncoded(record)
+	return off, err
+}
+
+// appendEncoded appends the record like Append, and returns it encoded as it's stored.
+func (s *segment) appendEncoded(record *api.Record) (off uint64, p []byte, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
 
-	p, err := proto.Marshal(record)
+	p, err = proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	if err := s.index.Write(
@@ -81,35 +101,90 @@ func (s *segment) Append(record *api.Record) (off uint64, err error) {
 		uint32(s.nextOffset-uint64(s.baseOffset)),
 		pos,
 	); err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	s.nextOffset++
+	if record.Timestamp > s.maxTimestamp {
+		s.maxTimestamp = record.Timestamp
+	}
 
-	return cur, nil
+	return cur, p, nil
 }
 
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	p, err := s.ReadEncoded(nil, off)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &api.Record{}
+	if err := proto.Unmarshal(p, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ReadEncoded appends the record at the offset to dst as it's encoded in the store.
+func (s *segment) ReadEncoded(dst []byte, off uint64) ([]byte, error) {
 	_, pos, err := s.index.Read(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, fmt.Errorf("index failed: %w", err)
 	}
 
-	p, err := s.store.Read(pos)
+	p, err := s.store.ReadAppend(dst, pos)
 	if err != nil {
 		return nil, fmt.Errorf("store failed: %w", err)
 	}
 
-	r := &api.Record{}
-	if err := proto.Unmarshal(p, r); err != nil {
-		return nil, err
-	}
+	return p, nil
+}
 
-	return r, nil
+// rebuildIndex rebuilds the index from the records in the store, when the index was lost.
+// It stops at a record cut short, which a crash may leave at the end of the store.
+func (s *segment) rebuildIndex() error {
+	var size [recordLengthBytes]byte
+	for pos := uint64(headerBytes); pos+recordLengthBytes <= s.store.size; {
+		if _, err := s.store.ReadAt(size[:], int64(pos)); err != nil {
+			return err
+		}
+		length := enc.Uint64(size[:]) &^ encryptedFrame
+		if length > s.store.size-pos-recordLengthBytes {
+			break
+		}
+
+		if err := s.index.Write(uint32(s.nextOffset-s.baseOffset), pos); err != nil {
+			return err
+		}
+		s.nextOffset++
+		pos += recordLengthBytes + length
+	}
+	return nil
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.maxStoreBytes || s.index.size >= s.maxIndexBytes
+	return s.storeBytes() >= s.maxStoreBytes || s.index.size >= s.maxIndexBytes
+}
+
+// storeBytes returns the size of the records in the store, not counting its header.
+func (s *segment) storeBytes() uint64 {
+	return s.store.size - headerBytes
+}
+
+// size returns the size of the records and their index entries in the segment.
+func (s *segment) size() uint64 {
+	return s.storeBytes() + s.index.size
+}
+
+// IsAged returns whether the segment was created longer than the age before now,
+// in milliseconds. The timestamps of the records come from the clients, so they don't
+// tell the age. Empty segments never age.
+func (s *segment) IsAged(age time.Duration, now int64) bool {
+	if age == 0 || s.nextOffset == s.baseOffset {
+		return false
+	}
+	return now-s.createdAt >= int64(age/time.Millisecond)
 }
 
 func (s *segment) Close() error {
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -28,6 +29,8 @@ func TestSegment(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, 16+i, off)
 
+		// the records are read once they're committed.
+		require.NoError(t, s.store.Commit())
 		got, err := s.Read(off)
 		require.NoError(t, err)
 		require.Equal(t, want.Value, got.Value)
@@ -52,3 +55,24 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegment_IsAged(t *testing.T) {
+	dir, _ := os.MkdirTemp(os.TempDir(), "segment-test")
+	defer os.RemoveAll(dir)
+
+	s, err := newSegment(dir, 0, 1024, 1024)
+	require.NoError(t, err)
+	defer s.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	hour := int64(time.Hour / time.Millisecond)
+	require.False(t, s.IsAged(time.Hour, now+2*hour), "empty segments never age")
+
+	// the timestamps of the records, skewed either way, don't age the segment.
+	for _, ts := range []int64{now - 2*hour, now + 2*hour} {
+		_, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	require.False(t, s.IsAged(time.Hour, now))
+	require.True(t, s.IsAged(time.Hour, s.createdAt+hour))
+}
@@ -0,0 +1,207 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+
+	"go.uber.org/zap"
+)
+
+// stateSnapshotFile is the snapshot of the state of the producers, transactions and keys,
+// in the log's directory. It's taken as the segments roll, like Kafka's producer state
+// checkpoints, so that the log is opened from it and the records appended since,
+// rather than from every record.
+const stateSnapshotFile = "state-snapshot"
+
+type stateSnapshot struct {
+	// Offset is the base offset of the segment rolled to, the records below it
+	// being the ones the snapshot covers.
+	Offset              uint64             `json:"offset"`
+	LastProducerID      uint64             `json:"last_producer_id"`
+	Producers           []producerSnapshot `json:"producers"`
+	OpenTransactions    map[uint64]uint64  `json:"open_transactions"`
+	AbortedTransactions map[uint64]uint64  `json:"aborted_transactions"`
+	Keys                []keySnapshot      `json:"keys"`
+	// MaxTimestamps are the latest timestamps of the segments below the offset,
+	// by their base offsets.
+	MaxTimestamps map[uint64]int64 `json:"max_timestamps"`
+}
+
+type producerSnapshot struct {
+	ID           uint64   `json:"id"`
+	LastSequence uint64   `json:"last_sequence"`
+	Offsets      []uint64 `json:"offsets"`
+	LastActive   int64    `json:"last_active"`
+}
+
+type keySnapshot struct {
+	Key    []byte `json:"key"`
+	Offset uint64 `json:"offset"`
+}
+
+// rollSegment rolls the active segment to a new one at the offset,
+// and snapshots the state as of it.
+func (l *Log) rollSegment(off uint64) error {
+	if err := l.newSegment(off); err != nil {
+		return err
+	}
+
+	l.snapshotInBackground()
+	return nil
+}
+
+// snapshotInBackground snapshots the state without holding up the append that rolled
+// the segment. It's called with the lock held, and copies the state for the snapshot
+// to be encoded and written without it, one snapshot at a time. The snapshots taken
+// while one is written are written after it, the latest one only.
+func (l *Log) snapshotInBackground() {
+	s := l.stateSnapshot()
+
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+
+	l.pendingSnapshot = &s
+	if l.snapshotting {
+		return
+	}
+	l.snapshotting = true
+	l.snapshots.Add(1)
+	go l.writeSnapshots()
+}
+
+// writeSnapshots writes the pending snapshots until there are none left.
+func (l *Log) writeSnapshots() {
+	defer l.snapshots.Done()
+
+	for {
+		l.snapshotMu.Lock()
+		s := l.pendingSnapshot
+		l.pendingSnapshot = nil
+		if s == nil {
+			l.snapshotting = false
+			l.snapshotMu.Unlock()
+			return
+		}
+		l.snapshotMu.Unlock()
+
+		// the snapshot only spares the records from being replayed, so the log carries on without it.
+		if err := l.writeSnapshot(*s); err != nil {
+			zap.L().Named("log").Warn("failed to snapshot the state", zap.String("dir", l.dir), zap.Error(err))
+		}
+	}
+}
+
+// waitSnapshots drops the pending snapshots and waits for the one being written, if any.
+// It's called with the lock held, which the snapshots are written without.
+func (l *Log) waitSnapshots() {
+	l.snapshotMu.Lock()
+	l.pendingSnapshot = nil
+	l.snapshotMu.Unlock()
+
+	l.snapshots.Wait()
+}
+
+// stateSnapshot copies the state as of the active segment.
+func (l *Log) stateSnapshot() stateSnapshot {
+	s := stateSnapshot{
+		Offset:              l.activeSegment.baseOffset,
+		LastProducerID:      l.lastProducerID,
+		OpenTransactions:    make(map[uint64]uint64, len(l.openTransactions)),
+		AbortedTransactions: make(map[uint64]uint64, len(l.abortedTransactions)),
+		Producers:           make([]producerSnapshot, 0, len(l.producers)),
+		Keys:                make([]keySnapshot, 0, len(l.keyOffsets)),
+		MaxTimestamps:       make(map[uint64]int64, len(l.segments)-1),
+	}
+	for id, off := range l.openTransactions {
+		s.OpenTransactions[id] = off
+	}
+	for id, off := range l.abortedTransactions {
+		s.AbortedTransactions[id] = off
+	}
+	for id, p := range l.producers {
+		s.Producers = append(s.Producers, producerSnapshot{
+			ID:           id,
+			LastSequence: p.lastSequence,
+			Offsets:      append([]uint64(nil), p.offsets...),
+			LastActive:   p.lastActive,
+		})
+	}
+	for key, off := range l.keyOffsets {
+		s.Keys = append(s.Keys, keySnapshot{Key: []byte(key), Offset: off})
+	}
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		s.MaxTimestamps[seg.baseOffset] = seg.maxTimestamp
+	}
+	return s
+}
+
+func (l *Log) writeSnapshot(s stateSnapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(l.dir, stateSnapshotFile), b)
+}
+
+// loadSnapshot restores the state from the snapshot, and returns the offset
+// the records are replayed from. A snapshot that doesn't match the segments,
+// e.g. since records past it were lost, is ignored and every record is replayed.
+func (l *Log) loadSnapshot() (uint64, error) {
+	from := l.segments[0].baseOffset
+
+	b, err := os.ReadFile(path.Join(l.dir, stateSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return from, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var s stateSnapshot
+	if err := json.Unmarshal(b, &s); err != nil || !l.matchSnapshot(s) {
+		zap.L().Named("log").Warn("ignoring the state snapshot", zap.String("dir", l.dir), zap.Error(err))
+		return from, nil
+	}
+
+	l.lastProducerID = s.LastProducerID
+	for _, p := range s.Producers {
+		l.producers[p.ID] = &producerState{
+			lastSequence: p.LastSequence,
+			offsets:      p.Offsets,
+			lastActive:   p.LastActive,
+		}
+	}
+	for id, off := range s.OpenTransactions {
+		l.openTransactions[id] = off
+	}
+	for id, off := range s.AbortedTransactions {
+		l.abortedTransactions[id] = off
+	}
+	for _, k := range s.Keys {
+		l.keyOffsets[string(k.Key)] = k.Offset
+	}
+	for _, seg := range l.segments {
+		if seg.baseOffset < s.Offset {
+			seg.maxTimestamp = s.MaxTimestamps[seg.baseOffset]
+		}
+	}
+
+	return s.Offset, nil
+}
+
+// matchSnapshot returns whether the snapshot was taken at the base offset of one of
+// the segments, with the segments below it holding every record up to it.
+func (l *Log) matchSnapshot(s stateSnapshot) bool {
+	for i, seg := range l.segments {
+		if seg.baseOffset != s.Offset {
+			if _, ok := s.MaxTimestamps[seg.baseOffset]; !ok || seg.baseOffset > s.Offset {
+				return false
+			}
+			continue
+		}
+		return i == 0 || l.segments[i-1].nextOffset == s.Offset
+	}
+	return false
+}
@@ -3,8 +3,10 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -15,11 +17,22 @@ const (
 	recordLengthBytes = 8
 )
 
+// errUncommitted is returned reading past the committed records, which the log
+// commits in the background shortly after they're appended.
+var errUncommitted = errors.New("record isn't committed yet")
+
 type store struct {
+	// committed is the size of the records flushed to the file. Records within it
+	// never change, so they're read with pread without taking the lock.
+	committed uint64
+
 	f    *os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+
+	// encryptor, if set, encrypts the records appended.
+	encryptor *encryptor
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -30,9 +43,10 @@ func newStore(f *os.File) (*store, error) {
 
 	size := fi.Size()
 	return &store{
-		f:    f,
-		size: uint64(size),
-		buf:  bufio.NewWriter(f),
+		committed: uint64(size),
+		f:         f,
+		size:      uint64(size),
+		buf:       bufio.NewWriter(f),
 	}, nil
 }
 
@@ -42,9 +56,17 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 	pos = s.size
 
+	length := uint64(len(p))
+	if s.encryptor != nil {
+		if p, err = s.encryptor.seal(pos, p); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(len(p)) | encryptedFrame
+	}
+
 	// write the record's length, so that we read the record,
 	// we know how many bytes to read.
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	if err := binary.Write(s.buf, enc, length); err != nil {
 		return 0, 0, err
 	}
 
@@ -55,43 +77,76 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 	n = uint64(pn) + recordLengthBytes
 	s.size += n
+	// the writer flushes whenever its buffer fills up, so the records are committed
+	// in batches without flushing each of them.
+	atomic.StoreUint64(&s.committed, s.size-uint64(s.buf.Buffered()))
 
 	return n, pos, nil
 }
 
-func (s *store) Read(pos uint64) ([]byte, error) {
+// Commit flushes the appended records to the file, and publishes the committed size
+// so that they're read without the lock. The segments commit their stores as they're
+// rolled, and the log commits the active one in the background as records are appended.
+func (s *store) Commit() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// first flushes the writer buffer,
-	//in case we're about to try to read a record that the buffer hasn't flushed to disk yet.
+	return s.commit()
+}
+
+func (s *store) commit() error {
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return err
 	}
+	atomic.StoreUint64(&s.committed, s.size)
+	return nil
+}
+
+// Committed returns the size of the records flushed to the file.
+func (s *store) Committed() uint64 {
+	return atomic.LoadUint64(&s.committed)
+}
+
+func (s *store) Read(pos uint64) ([]byte, error) {
+	return s.ReadAppend(nil, pos)
+}
 
-	size := make([]byte, recordLengthBytes)
-	if _, err := s.f.ReadAt(size, int64(pos)); err != nil {
+// ReadAppend appends the record at pos to dst, reading it straight into dst's
+// spare capacity when there's enough of it. Encrypted records are decrypted.
+func (s *store) ReadAppend(dst []byte, pos uint64) ([]byte, error) {
+	var size [recordLengthBytes]byte
+	if _, err := s.ReadAt(size[:], int64(pos)); err != nil {
 		return nil, err
 	}
 
-	dst := make([]byte, enc.Uint64(size))
-	if _, err := s.f.ReadAt(dst, int64(pos+recordLengthBytes)); err != nil {
+	length := enc.Uint64(size[:])
+	if length&encryptedFrame != 0 {
+		sealed := make([]byte, length&^encryptedFrame)
+		if _, err := s.ReadAt(sealed, int64(pos+recordLengthBytes)); err != nil {
+			return nil, err
+		}
+		return s.encryptor.open(dst, pos, sealed)
+	}
+
+	n := int(length)
+	if cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	if _, err := s.ReadAt(dst[len(dst):len(dst)+n], int64(pos+recordLengthBytes)); err != nil {
 		return nil, err
 	}
 
-	return dst, nil
+	return dst[:len(dst)+n], nil
 }
 
+// ReadAt reads the committed records, failing with errUncommitted past them
+// rather than flushing the writer.
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// first flushes the writer buffer,
-	//in case we're about to try to read a record that the buffer hasn't flushed to disk yet.
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	if uint64(off)+uint64(len(p)) > s.Committed() {
+		return 0, errUncommitted
 	}
-
 	return s.f.ReadAt(p, off)
 }
 
@@ -2,6 +2,7 @@ package log
 
 import (
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -22,6 +23,7 @@ func TestStore_AppendRead(t *testing.T) {
 	require.NoError(t, err)
 
 	testAppend(t, s)
+	require.NoError(t, s.Commit())
 	testRead(t, s)
 	testReadAt(t, s)
 }
@@ -85,6 +87,53 @@ func TestStore_Close(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStore_Committed(t *testing.T) {
+	f, err := os.CreateTemp("", "store_committed_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, _, err = s.Append(testRecord)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), s.Committed())
+	require.NoError(t, s.Commit())
+	require.Equal(t, testRecordSize, s.Committed())
+
+	// records that aren't committed yet aren't read, and reading them doesn't flush the writer.
+	_, pos, err := s.Append(testRecord)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errUncommitted, err)
+	require.Equal(t, testRecordSize, s.Committed())
+	require.NoError(t, s.Commit())
+	b, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, testRecord, b)
+
+	// committed records are read while records are appended.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b, err := s.Read(0)
+				require.NoError(t, err)
+				require.Equal(t, testRecord, b)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		_, _, err := s.Append(testRecord)
+		require.NoError(t, err)
+		require.NoError(t, s.Commit())
+	}
+	wg.Wait()
+}
+
 func openFile(name string) (size int64, err error) {
 	f, err := os.Open(name)
 	if err != nil {
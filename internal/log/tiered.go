@@ -0,0 +1,476 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ObjectStore stores the segments offloaded from the local disk, as objects by name.
+type ObjectStore interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	// Delete deletes the object, if it exists.
+	Delete(name string) error
+}
+
+var _ ObjectStore = (*LocalObjectStore)(nil)
+
+// LocalObjectStore is an ObjectStore keeping the objects as files in a directory,
+// e.g. on a network file system.
+type LocalObjectStore struct {
+	dir string
+}
+
+func NewLocalObjectStore(dir string) (*LocalObjectStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalObjectStore{dir: dir}, nil
+}
+
+// Put writes the object atomically. Names with slashes are kept in subdirectories.
+func (s *LocalObjectStore) Put(name string, r io.Reader) error {
+	name = s.path(name)
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(path.Dir(name), path.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func (s *LocalObjectStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalObjectStore) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalObjectStore) path(name string) string {
+	return path.Join(s.dir, path.Clean("/"+name))
+}
+
+const (
+	// remoteSegmentsFile lists the segments offloaded to the object store, in the log's directory.
+	remoteSegmentsFile = "remote-segments"
+	// fetchedDir is the directory in the log's directory the remote segments are fetched to.
+	fetchedDir = "remote"
+	// fetchedSegments is how many fetched segments are kept for the next reads.
+	fetchedSegments = 4
+)
+
+// remoteSegment describes a segment offloaded to the object store.
+type remoteSegment struct {
+	BaseOffset   uint64 `json:"base_offset"`
+	NextOffset   uint64 `json:"next_offset"`
+	StoreBytes   uint64 `json:"store_bytes"`
+	IndexBytes   uint64 `json:"index_bytes"`
+	MaxTimestamp int64  `json:"max_timestamp"`
+}
+
+// SetObjectStore sets the object store the oldest segments are offloaded to, past the local
+// retention, with their objects named after them behind the prefix.
+// Reads of the offloaded records fetch their segments back on demand.
+func (l *Log) SetObjectStore(store ObjectStore, prefix string) error {
+	l.mu.Lock()
+	err := l.checkOpen()
+	if err == nil {
+		l.objectStore, l.objectPrefix = store, prefix
+		err = l.enforceRetention()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return l.offloadSegments()
+}
+
+// offloadSegments offloads the oldest segments past the local retention to the object store.
+// The active segment is never offloaded.
+// The segments are uploaded without holding the lock, so that the appends and reads go on
+// meanwhile, and are only swapped for their remote copies once they're uploaded.
+// A segment that fails to upload stays local.
+func (l *Log) offloadSegments() error {
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+
+	for {
+		l.mu.RLock()
+		seg := l.segmentToOffload()
+		if seg == nil {
+			l.mu.RUnlock()
+			return nil
+		}
+		store, prefix := l.objectStore, l.objectPrefix
+		up, err := newSegmentUpload(seg)
+		l.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		err = up.put(store, prefix)
+		up.close()
+		if err != nil {
+			return err
+		}
+
+		if err := l.swapOffloaded(seg, up.remote, store, prefix); err != nil {
+			return err
+		}
+	}
+}
+
+// offloadInBackground offloads the segments past the local retention without holding up
+// the append that rolled them. It's called with the lock held.
+// The failures are logged and counted in the stats, and the segments are offloaded on the next try.
+func (l *Log) offloadInBackground() {
+	if l.objectStore == nil || l.closed {
+		return
+	}
+
+	l.offloads.Add(1)
+	go func() {
+		defer l.offloads.Done()
+
+		if err := l.offloadSegments(); err != nil {
+			l.mu.Lock()
+			l.offloadFailures++
+			l.mu.Unlock()
+			zap.L().Named("log").Error("failed to offload segments", zap.String("dir", l.dir), zap.Error(err))
+		}
+	}()
+}
+
+// segmentToOffload returns the oldest segment past the local retention, if there's one.
+func (l *Log) segmentToOffload() *segment {
+	if l.objectStore == nil || l.closed || len(l.segments) < 2 {
+		return nil
+	}
+
+	var size uint64
+	for _, seg := range l.segments {
+		size += seg.size()
+	}
+	cutoff := time.Now().Add(-l.localRetentionTime).UnixNano() / int64(time.Millisecond)
+
+	seg := l.segments[0]
+	oversized := l.localRetentionBytes > 0 && size > l.localRetentionBytes
+	// the segment's age is measured from its creation, by the server's clock,
+	// rather than from the timestamps the clients set on the records.
+	expired := l.localRetentionTime > 0 && seg.createdAt < cutoff
+	if !oversized && !expired {
+		return nil
+	}
+	return seg
+}
+
+// segmentUpload is a copy of a segment to upload: its store, read through a file of its own
+// so that it stays readable if the segment is removed meanwhile, and its index entries.
+type segmentUpload struct {
+	remote     remoteSegment
+	store      *os.File
+	storeBytes int64
+	index      []byte
+}
+
+// newSegmentUpload copies the segment to upload. It's called with the lock held.
+func newSegmentUpload(seg *segment) (*segmentUpload, error) {
+	if err := seg.store.Commit(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(seg.store.f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentUpload{
+		remote: remoteSegment{
+			BaseOffset:   seg.baseOffset,
+			NextOffset:   seg.nextOffset,
+			StoreBytes:   seg.storeBytes(),
+			IndexBytes:   seg.index.size,
+			MaxTimestamp: seg.maxTimestamp,
+		},
+		store:      f,
+		storeBytes: int64(seg.store.size),
+		// the index file is larger than its entries until the segment is closed.
+		index: append([]byte(nil), seg.index.mmap[:headerBytes+seg.index.size]...),
+	}, nil
+}
+
+func (u *segmentUpload) put(store ObjectStore, prefix string) error {
+	name := fmt.Sprintf("%s%d", prefix, u.remote.BaseOffset)
+	if err := store.Put(name+".store", io.NewSectionReader(u.store, 0, u.storeBytes)); err != nil {
+		return err
+	}
+	return store.Put(name+".index", bytes.NewReader(u.index))
+}
+
+func (u *segmentUpload) close() error {
+	return u.store.Close()
+}
+
+// swapOffloaded replaces the uploaded segment with its remote copy. If the segment was removed,
+// or the object store changed, while it was uploaded, the uploaded objects are deleted instead.
+func (l *Log) swapOffloaded(seg *segment, rs remoteSegment, store ObjectStore, prefix string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || len(l.segments) < 2 || l.segments[0] != seg || l.objectStore != store || l.objectPrefix != prefix {
+		return deleteObjects(store, prefix, rs.BaseOffset)
+	}
+
+	l.remoteSegments = append(l.remoteSegments, rs)
+	if err := l.persistRemoteSegments(); err != nil {
+		l.remoteSegments = l.remoteSegments[:len(l.remoteSegments)-1]
+		return err
+	}
+
+	l.segments = l.segments[1:]
+	return seg.Remove()
+}
+
+func deleteObjects(store ObjectStore, prefix string, baseOffset uint64) error {
+	for _, ext := range []string{".store", ".index"} {
+		if err := store.Delete(fmt.Sprintf("%s%d%s", prefix, baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRemote deletes the oldest remote segment from the object store.
+func (l *Log) removeRemote() error {
+	rs := l.remoteSegments[0]
+	l.evictFetched(rs.BaseOffset)
+	if l.objectStore != nil {
+		if err := deleteObjects(l.objectStore, l.objectPrefix, rs.BaseOffset); err != nil {
+			return err
+		}
+	}
+
+	l.remoteSegments = l.remoteSegments[1:]
+	return l.persistRemoteSegments()
+}
+
+// remoteSegment returns the remote segment holding the offset.
+func (l *Log) remoteSegment(off uint64) (remoteSegment, bool) {
+	i := sort.Search(len(l.remoteSegments), func(i int) bool {
+		return l.remoteSegments[i].BaseOffset > off
+	})
+	if i == 0 || l.remoteSegments[i-1].NextOffset <= off {
+		return remoteSegment{}, false
+	}
+	return l.remoteSegments[i-1], true
+}
+
+// readRemote appends the record at the offset in the remote segment to dst.
+// It fails with a *fetchNeeded if the segment isn't fetched yet.
+func (l *Log) readRemote(dst []byte, rs remoteSegment, off uint64) ([]byte, error) {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	seg, err := l.fetchedSegment(rs)
+	if err != nil {
+		return nil, err
+	}
+	return seg.ReadEncoded(dst, off)
+}
+
+func (l *Log) remoteOffsetForTime(rs remoteSegment, timestamp int64) (uint64, bool, error) {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	seg, err := l.fetchedSegment(rs)
+	if err != nil {
+		return 0, false, err
+	}
+	return l.offsetForTime(seg, timestamp)
+}
+
+// fetchNeeded is returned reading a remote segment that isn't fetched yet.
+// The segment is fetched without holding the lock, and the read is then run again.
+type fetchNeeded struct {
+	segment remoteSegment
+	store   ObjectStore
+	prefix  string
+}
+
+func (e *fetchNeeded) Error() string {
+	return fmt.Sprintf("segment %d isn't fetched yet", e.segment.BaseOffset)
+}
+
+// fetchedSegment returns the remote segment if it's one of the segments last fetched,
+// and a *fetchNeeded otherwise. It's called with the lock and fetchMu held.
+func (l *Log) fetchedSegment(rs remoteSegment) (*segment, error) {
+	for i, seg := range l.fetched {
+		if seg.baseOffset == rs.BaseOffset {
+			l.fetched = append(append(l.fetched[:i:i], l.fetched[i+1:]...), seg)
+			return seg, nil
+		}
+	}
+
+	if l.objectStore == nil {
+		return nil, fmt.Errorf("segment %d was offloaded, but there's no object store to fetch it from", rs.BaseOffset)
+	}
+	return nil, &fetchNeeded{segment: rs, store: l.objectStore, prefix: l.objectPrefix}
+}
+
+// fetch downloads the remote segment from the object store without holding the lock,
+// like offloadSegments uploads them, and only takes the lock to add it to the fetched
+// segments. It's dropped if it was fetched, or removed, while it was downloaded.
+func (l *Log) fetch(f *fetchNeeded) error {
+	dir := path.Join(l.dir, fetchedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, "fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	rs := f.segment
+	for _, ext := range []string{".store", ".index"} {
+		if err := download(f.store, fmt.Sprintf("%s%d%s", f.prefix, rs.BaseOffset, ext), path.Join(tmp, fmt.Sprintf("%d%s", rs.BaseOffset, ext))); err != nil {
+			return err
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	if current, ok := l.remoteSegment(rs.BaseOffset); l.closed || !ok || current != rs || l.objectStore != f.store || l.objectPrefix != f.prefix {
+		return nil
+	}
+	for _, seg := range l.fetched {
+		if seg.baseOffset == rs.BaseOffset {
+			return nil
+		}
+	}
+
+	for _, ext := range []string{".store", ".index"} {
+		name := fmt.Sprintf("%d%s", rs.BaseOffset, ext)
+		if err := os.Rename(path.Join(tmp, name), path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	seg, err := newSegment(dir, rs.BaseOffset, rs.StoreBytes, rs.IndexBytes)
+	if err != nil {
+		return err
+	}
+	seg.maxTimestamp = rs.MaxTimestamp
+	seg.store.encryptor = l.encryptor
+
+	l.fetched = append(l.fetched, seg)
+	if len(l.fetched) > fetchedSegments {
+		oldest := l.fetched[0]
+		l.fetched = l.fetched[1:]
+		if err := oldest.Remove(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func download(store ObjectStore, name, file string) error {
+	r, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// evictFetched removes the fetched copy of the remote segment, if there's one.
+func (l *Log) evictFetched(baseOffset uint64) {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	for i, seg := range l.fetched {
+		if seg.baseOffset == baseOffset {
+			seg.Remove()
+			l.fetched = append(l.fetched[:i:i], l.fetched[i+1:]...)
+			return
+		}
+	}
+}
+
+// closeFetched closes the fetched segments, and removes their files.
+func (l *Log) closeFetched() error {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	var removeErr error
+	for _, seg := range l.fetched {
+		if err := seg.Remove(); err != nil && removeErr == nil {
+			removeErr = err
+		}
+	}
+	l.fetched = nil
+	return removeErr
+}
+
+func (l *Log) persistRemoteSegments() error {
+	b, err := json.Marshal(l.remoteSegments)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(l.dir, remoteSegmentsFile), b)
+}
+
+func (l *Log) loadRemoteSegments() error {
+	l.remoteSegments = nil
+
+	b, err := os.ReadFile(path.Join(l.dir, remoteSegmentsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &l.remoteSegments)
+}
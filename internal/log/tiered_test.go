@@ -0,0 +1,41 @@
+package log
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalObjectStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "object-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalObjectStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("0.store", strings.NewReader("hello world")))
+	r, err := store.Get("0.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "hello world", string(b))
+
+	// names can't escape the directory.
+	require.NoError(t, store.Put("../0.store", strings.NewReader("hello again")))
+	r, err = store.Get("0.store")
+	require.NoError(t, err)
+	b, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "hello again", string(b))
+
+	require.NoError(t, store.Delete("0.store"))
+	_, err = store.Get("0.store")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, store.Delete("0.store"))
+}
@@ -0,0 +1,365 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+var topicNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Topic is a named log along with the offsets committed by its consumer groups.
+type Topic struct {
+	Name    string
+	Log     *Log
+	Offsets *Offsets
+	// Dir is the data directory the topic is kept in.
+	Dir string
+}
+
+// Topics manages the topics in one or more data directories, e.g. one per disk.
+// Each topic has its log in a subdirectory named after it, and its offsets
+// in a "<name>.offsets" file beside it.
+//
+// New topics are placed in the data directory with the most free space.
+// A data directory that fails, whether its check or an append or read of one
+// of its topics does, is taken offline along with its topics, which return
+// api.ErrTopicOffline, while the other directories keep serving.
+type Topics struct {
+	mu                           sync.RWMutex
+	dirs                         []*dataDir
+	maxStoreBytes, maxIndexBytes uint64
+	topics                       map[string]*Topic
+	// offline maps the topics that are offline to their data directories.
+	offline map[string]*dataDir
+	logger  *zap.Logger
+	closed  bool
+	// onOpen and onClose are called with the topics as they're opened and closed.
+	onOpen, onClose func(*Topic)
+}
+
+type dataDir struct {
+	path string
+	// err is why the directory is offline, nil while it's online.
+	err error
+}
+
+// DirStatus describes the health of a data directory.
+type DirStatus struct {
+	Path string
+	// Err is why the directory is offline, nil while it's online.
+	Err       error
+	FreeBytes uint64
+	// Topics are the topics in the directory, including the offline ones.
+	Topics []string
+}
+
+// NewTopics opens the topics already in the directory.
+func NewTopics(dir string, maxStoreBytes, maxIndexBytes uint64) (*Topics, error) {
+	return NewTopicsInDirs([]string{dir}, maxStoreBytes, maxIndexBytes)
+}
+
+// NewTopicsInDirs opens the topics already in the data directories.
+// The directories that can't be read are taken offline, and the topics that
+// can't be opened are offline too. It fails only if every directory is offline.
+func NewTopicsInDirs(dirs []string, maxStoreBytes, maxIndexBytes uint64) (*Topics, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("no data directories")
+	}
+
+	t := &Topics{
+		maxStoreBytes: maxStoreBytes,
+		maxIndexBytes: maxIndexBytes,
+		topics:        map[string]*Topic{},
+		offline:       map[string]*dataDir{},
+		logger:        zap.L().Named("topics"),
+	}
+
+	var online int
+	for _, p := range dirs {
+		dir := &dataDir{path: p}
+		t.dirs = append(t.dirs, dir)
+
+		files, err := os.ReadDir(p)
+		if err != nil {
+			t.logger.Error("data directory offline", zap.String("dir", p), zap.Error(err))
+			dir.err = err
+			continue
+		}
+		online++
+
+		for _, f := range files {
+			if !f.IsDir() || !topicNameRegexp.MatchString(f.Name()) {
+				continue
+			}
+			if other, ok := t.dir(f.Name()); ok {
+				t.Close()
+				return nil, fmt.Errorf("topic %s is in both %s and %s", f.Name(), other.path, p)
+			}
+			if _, err := t.open(dir, f.Name()); err != nil {
+				t.logger.Error("topic offline", zap.String("topic", f.Name()), zap.String("dir", p), zap.Error(err))
+				t.offline[f.Name()] = dir
+			}
+		}
+	}
+	if online == 0 {
+		t.Close()
+		return nil, t.dirs[0].err
+	}
+
+	return t, nil
+}
+
+// Get returns the topic, creating it if it doesn't exist yet and create is set.
+// It returns api.ErrTopicNotFound otherwise, or api.ErrTopicOffline for the offline topics.
+func (t *Topics) Get(name string, create bool) (*Topic, error) {
+	t.mu.RLock()
+	topic, ok := t.topics[name]
+	_, offline := t.offline[name]
+	t.mu.RUnlock()
+	if ok {
+		return topic, nil
+	}
+	if offline {
+		return nil, api.ErrTopicOffline{Name: name}
+	}
+	if !create {
+		return nil, api.ErrTopicNotFound{Name: name}
+	}
+
+	if !topicNameRegexp.MatchString(name) || name == "." || name == ".." {
+		return nil, api.ErrInvalidTopicName{Name: name}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if topic, ok := t.topics[name]; ok {
+		return topic, nil
+	}
+	if _, ok := t.offline[name]; ok {
+		return nil, api.ErrTopicOffline{Name: name}
+	}
+
+	dir, err := t.place()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Join(dir.path, name), 0755); err != nil {
+		return nil, err
+	}
+	return t.open(dir, name)
+}
+
+// place returns the online data directory with the most free space.
+func (t *Topics) place() (*dataDir, error) {
+	var best *dataDir
+	var bestFree uint64
+	for _, dir := range t.dirs {
+		if dir.err != nil {
+			continue
+		}
+		free, err := freeBytes(dir.path)
+		if err != nil {
+			continue
+		}
+		if best == nil || free > bestFree {
+			best, bestFree = dir, free
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no data directory is online")
+	}
+	return best, nil
+}
+
+// Names returns the names of the online topics, sorted.
+func (t *Topics) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := make([]string, 0, len(t.topics))
+	for name := range t.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckDirs checks that the online data directories are still writable, taking the failed
+// ones offline, and returns the status of every directory.
+func (t *Topics) CheckDirs() []DirStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]DirStatus, 0, len(t.dirs))
+	for _, dir := range t.dirs {
+		if dir.err == nil {
+			if err := probe(dir.path); err != nil {
+				t.takeOffline(dir, err)
+			}
+		}
+
+		status := DirStatus{Path: dir.path, Err: dir.err}
+		if dir.err == nil {
+			status.FreeBytes, _ = freeBytes(dir.path)
+		}
+		for name, topic := range t.topics {
+			if topic.Dir == dir.path {
+				status.Topics = append(status.Topics, name)
+			}
+		}
+		for name, d := range t.offline {
+			if d == dir {
+				status.Topics = append(status.Topics, name)
+			}
+		}
+		sort.Strings(status.Topics)
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// Watch calls opened with the online topics, and from then on with each topic opened,
+// and closed with each topic taken offline or closed. They're called with the topics locked,
+// so they must not call back into the topics.
+func (t *Topics) Watch(opened, closed func(*Topic)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onOpen, t.onClose = opened, closed
+	for _, topic := range t.topics {
+		opened(topic)
+	}
+}
+
+// takeOffline takes the data directory offline along with its topics,
+// closing their logs as well as they can be. The topics already handed out
+// fail with api.ErrTopicOffline from then on.
+func (t *Topics) takeOffline(dir *dataDir, err error) {
+	t.logger.Error("data directory offline", zap.String("dir", dir.path), zap.Error(err))
+	dir.err = err
+
+	for name, topic := range t.topics {
+		if topic.Dir != dir.path {
+			continue
+		}
+		offline := api.ErrTopicOffline{Name: name}
+		topic.Offsets.closeWith(offline)
+		if err := topic.Log.closeWith(offline); err != nil {
+			t.logger.Warn("failed to close offline topic", zap.String("topic", name), zap.Error(err))
+		}
+		delete(t.topics, name)
+		t.offline[name] = dir
+		if t.onClose != nil {
+			t.onClose(topic)
+		}
+	}
+}
+
+// fail takes the data directory offline once one of its topics failed with an I/O error.
+func (t *Topics) fail(dir *dataDir, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || dir.err != nil {
+		return
+	}
+	t.takeOffline(dir, err)
+}
+
+// dir returns the data directory of the topic, whether it's online or not.
+func (t *Topics) dir(name string) (*dataDir, bool) {
+	if topic, ok := t.topics[name]; ok {
+		for _, dir := range t.dirs {
+			if dir.path == topic.Dir {
+				return dir, true
+			}
+		}
+	}
+	dir, ok := t.offline[name]
+	return dir, ok
+}
+
+func (t *Topics) open(dir *dataDir, name string) (*Topic, error) {
+	l, err := NewLog(path.Join(dir.path, name), 0, t.maxStoreBytes, t.maxIndexBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := NewOffsets(path.Join(dir.path, name+".offsets"))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	// the failed directory is taken offline without waiting on the log,
+	// which may hold its lock while it reports the error.
+	l.onIOError = func(err error) {
+		go t.fail(dir, err)
+	}
+
+	topic := &Topic{Name: name, Log: l, Offsets: offsets, Dir: dir.path}
+	t.topics[name] = topic
+	if t.onOpen != nil {
+		t.onOpen(topic)
+	}
+	return topic, nil
+}
+
+// Close closes the logs and offsets of the online topics, carrying on past the ones
+// that fail to close, and returns their errors.
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	var err error
+	for _, topic := range t.topics {
+		err = multierr.Append(err, topic.Log.Close())
+		err = multierr.Append(err, topic.Offsets.Close())
+		if t.onClose != nil {
+			t.onClose(topic)
+		}
+	}
+
+	return err
+}
+
+// probe checks that the directory is writable.
+func probe(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte("probe")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func freeBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
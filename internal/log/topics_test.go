@@ -0,0 +1,134 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+
+	_, err = topics.Get("orders", false)
+	require.Equal(t, api.ErrTopicNotFound{Name: "orders"}, err)
+	_, err = topics.Get("../orders", true)
+	require.Equal(t, api.ErrInvalidTopicName{Name: "../orders"}, err)
+
+	orders, err := topics.Get("orders", true)
+	require.NoError(t, err)
+	_, err = orders.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, orders.Offsets.Commit("group", 1))
+	require.NoError(t, orders.Log.SetConfig(Config{RetentionBytes: 4096}))
+
+	_, err = topics.Get("payments", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, topics.Names())
+	require.NoError(t, topics.Close())
+	// the topics are closed along with their offsets.
+	_, err = orders.Log.Read(0)
+	require.Equal(t, ErrClosed, err)
+	require.Equal(t, ErrClosed, orders.Offsets.Commit("group", 2))
+
+	// the topics are opened again from the directory.
+	topics, err = NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.Equal(t, []string{"orders", "payments"}, topics.Names())
+
+	orders, err = topics.Get("orders", false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), orders.Log.Stats().NextOffset)
+	require.Equal(t, uint64(4096), orders.Log.Config().RetentionBytes, "the config is kept")
+	off, ok := orders.Offsets.Fetch("group")
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestTopics_Dirs(t *testing.T) {
+	root, err := os.MkdirTemp("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dirs := []string{path.Join(root, "a"), path.Join(root, "b")}
+	for _, dir := range dirs {
+		require.NoError(t, os.Mkdir(dir, 0755))
+	}
+
+	// a directory that can't be read is offline, rather than failing the others.
+	topics, err := NewTopicsInDirs(append(dirs, path.Join(root, "missing")), 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	orders, err := topics.Get("orders", true)
+	require.NoError(t, err)
+	require.Contains(t, dirs, orders.Dir)
+
+	statuses := topics.CheckDirs()
+	require.Len(t, statuses, 3)
+	require.Error(t, statuses[2].Err)
+	for _, status := range statuses[:2] {
+		require.NoError(t, status.Err)
+		require.NotZero(t, status.FreeBytes)
+	}
+
+	// the failed directory is taken offline along with its topics.
+	require.NoError(t, os.RemoveAll(orders.Dir))
+	for _, status := range topics.CheckDirs() {
+		if status.Path == orders.Dir {
+			require.Error(t, status.Err)
+			require.Equal(t, []string{"orders"}, status.Topics)
+		}
+	}
+	_, err = topics.Get("orders", true)
+	require.Equal(t, api.ErrTopicOffline{Name: "orders"}, err)
+	require.Empty(t, topics.Names())
+	// so is the topic handed out before.
+	_, err = orders.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrTopicOffline{Name: "orders"}, err)
+	_, err = orders.Log.Read(0)
+	require.Equal(t, api.ErrTopicOffline{Name: "orders"}, err)
+	require.Equal(t, api.ErrTopicOffline{Name: "orders"}, orders.Offsets.Commit("group", 1))
+
+	// new topics are placed in the directories still online.
+	payments, err := topics.Get("payments", true)
+	require.NoError(t, err)
+	require.NotEqual(t, orders.Dir, payments.Dir)
+	_, err = payments.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+func TestTopics_IOError(t *testing.T) {
+	dir, err := os.MkdirTemp("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	orders, err := topics.Get("orders", true)
+	require.NoError(t, err)
+	_, err = orders.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// a read failing with an I/O error takes the directory offline, without waiting for its check.
+	require.NoError(t, orders.Log.activeSegment.store.f.Close())
+	_, err = orders.Log.Read(0)
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		_, err := topics.Get("orders", false)
+		return err == api.ErrTopicOffline{Name: "orders"}
+	}, time.Second, 10*time.Millisecond)
+	_, err = orders.Log.Read(0)
+	require.Equal(t, api.ErrTopicOffline{Name: "orders"}, err)
+}
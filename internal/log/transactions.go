@@ -0,0 +1,97 @@
+package log
+
+import (
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func (l *Log) trackTransaction(record *api.Record, off uint64) {
+	if record.TransactionId == 0 {
+		return
+	}
+
+	switch record.Control {
+	case api.Record_NONE:
+		if _, ok := l.openTransactions[record.TransactionId]; !ok {
+			l.openTransactions[record.TransactionId] = off
+		}
+	case api.Record_ABORT:
+		l.abortedTransactions[record.TransactionId] = off
+		fallthrough
+	default:
+		delete(l.openTransactions, record.TransactionId)
+	}
+}
+
+// pruneTransactions forgets the aborted transactions whose control records are below
+// the offset, their records being below it too.
+func (l *Log) pruneTransactions(lowest uint64) {
+	for id, off := range l.abortedTransactions {
+		if off < lowest {
+			delete(l.abortedTransactions, id)
+		}
+	}
+}
+
+// EndTransaction appends the control record ending the transaction,
+// unless the transaction has no open records in the log.
+func (l *Log) EndTransaction(id uint64, control api.Record_Control) error {
+	l.mu.Lock()
+	_, ok := l.openTransactions[id]
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	_, err := l.Append(&api.Record{TransactionId: id, Control: control})
+	return err
+}
+
+// LastStableOffset returns the offset of the first record of the transactions
+// that are still open, or the offset of the next record if there aren't any.
+// Records from this offset on aren't visible to read-committed reads yet.
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.lastStableOffset()
+}
+
+func (l *Log) lastStableOffset() uint64 {
+	lso := l.segments[len(l.segments)-1].nextOffset
+	for _, first := range l.openTransactions {
+		if first < lso {
+			lso = first
+		}
+	}
+	return lso
+}
+
+// ReadCommitted reads the first committed record at or after the offset,
+// skipping the control records and the records of aborted transactions.
+// Offsets from the last stable offset on are out of range, with the
+// last stable offset as the next offset.
+func (l *Log) ReadCommitted(off uint64) (record *api.Record, err error) {
+	err = l.readRetrying(func() error {
+		lso := l.lastStableOffset()
+		for cur := off; cur < lso; cur++ {
+			if record, err = l.read(cur); err != nil {
+				return err
+			}
+			if record.Control != api.Record_NONE {
+				continue
+			}
+			if _, ok := l.abortedTransactions[record.TransactionId]; ok {
+				continue
+			}
+			return nil
+		}
+
+		record = nil
+		return api.ErrOffsetOutOfRange{
+			Offset: off,
+			Lowest: l.lowestOffset(),
+			Next:   lso,
+		}
+	})
+	return record, err
+}
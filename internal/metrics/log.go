@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+// collector reports the metrics read by collect at scrape time, described by descs.
+type collector struct {
+	descs   []*prometheus.Desc
+	collect func(chan<- prometheus.Metric)
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch)
+}
+
+type LogStatser interface {
+	Stats() log.Stats
+}
+
+type logMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(log.Stats) uint64
+}
+
+// LogCollector reports the state of the log, labelled by its topic.
+func LogCollector(topic string, l LogStatser) prometheus.Collector {
+	labels := prometheus.Labels{"topic": topic}
+	metric := func(name, help string, valueType prometheus.ValueType, value func(log.Stats) uint64) logMetric {
+		return logMetric{desc: prometheus.NewDesc(name, help, nil, labels), valueType: valueType, value: value}
+	}
+	gauge, counter := prometheus.GaugeValue, prometheus.CounterValue
+
+	metrics := []logMetric{
+		metric("log_segments", "Number of segments in the log.", gauge,
+			func(s log.Stats) uint64 { return uint64(s.Segments) }),
+		metric("log_size_bytes", "Bytes of the stores and indexes on disk.", gauge,
+			func(s log.Stats) uint64 { return s.Bytes }),
+		metric("log_lowest_offset", "Lowest offset in the log.", gauge,
+			func(s log.Stats) uint64 { return s.LowestOffset }),
+		metric("log_highest_offset", "Highest offset in the log.", gauge,
+			func(s log.Stats) uint64 { return s.HighestOffset }),
+		metric("log_appended_records_total", "Records appended to the log.", counter,
+			func(s log.Stats) uint64 { return s.AppendedRecords }),
+		metric("log_appended_bytes_total", "Bytes appended to the log's stores.", counter,
+			func(s log.Stats) uint64 { return s.AppendedBytes }),
+		metric("log_cache_bytes", "Bytes of the records in the log's read cache.", gauge,
+			func(s log.Stats) uint64 { return s.CacheBytes }),
+		metric("log_cache_hits_total", "Reads served from the log's read cache.", counter,
+			func(s log.Stats) uint64 { return s.CacheHits }),
+		metric("log_cache_misses_total", "Reads missing the log's read cache.", counter,
+			func(s log.Stats) uint64 { return s.CacheMisses }),
+		metric("log_offload_failures_total", "Background offloads to the object store that failed.", counter,
+			func(s log.Stats) uint64 { return s.OffloadFailures }),
+	}
+
+	c := &collector{}
+	for _, m := range metrics {
+		c.descs = append(c.descs, m.desc)
+	}
+	c.collect = func(ch chan<- prometheus.Metric) {
+		stats := l.Stats()
+		for _, m := range metrics {
+			ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, float64(m.value(stats)))
+		}
+	}
+
+	return c
+}
+
+type ReplicationStatser interface {
+	Stats() map[string]log.PeerStats
+}
+
+// ReplicatorCollector reports the replication progress per peer.
+func ReplicatorCollector(r ReplicationStatser) prometheus.Collector {
+	labels := []string{"peer"}
+	replicated := prometheus.NewDesc("replicator_replicated_records_total", "Records replicated from the peer.", labels, nil)
+	offset := prometheus.NewDesc("replicator_replicated_offset", "Offset in the peer's log of the last replicated record.", labels, nil)
+	lag := prometheus.NewDesc("replicator_offset_lag", "Records in the peer's log yet to be replicated.", labels, nil)
+
+	return &collector{
+		descs: []*prometheus.Desc{replicated, offset, lag},
+		collect: func(ch chan<- prometheus.Metric) {
+			for peer, s := range r.Stats() {
+				ch <- prometheus.MustNewConstMetric(replicated, prometheus.CounterValue, float64(s.Replicated), peer)
+				ch <- prometheus.MustNewConstMetric(offset, prometheus.GaugeValue, float64(s.Offset), peer)
+				ch <- prometheus.MustNewConstMetric(lag, prometheus.GaugeValue, float64(s.Lag()), peer)
+			}
+		},
+	}
+}
+
+type GroupOffsetser interface {
+	Groups() map[string]uint64
+}
+
+// ConsumerLagCollector reports how many records of the log each consumer group
+// has yet to consume, labelled by the log's topic.
+func ConsumerLagCollector(topic string, l LogStatser, o GroupOffsetser) prometheus.Collector {
+	lag := prometheus.NewDesc("consumer_group_lag", "Records the consumer group has yet to consume.",
+		[]string{"group"}, prometheus.Labels{"topic": topic})
+
+	return &collector{
+		descs: []*prometheus.Desc{lag},
+		collect: func(ch chan<- prometheus.Metric) {
+			next := l.Stats().NextOffset
+			for g, committed := range o.Groups() {
+				var v uint64
+				if committed < next {
+					v = next - committed
+				}
+				ch <- prometheus.MustNewConstMetric(lag, prometheus.GaugeValue, float64(v), g)
+			}
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	ocprometheus "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry exposes the registered OpenCensus views, through the OpenCensus
+// Prometheus exporter, and the collectors to Prometheus.
+type Registry struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	mu         sync.Mutex
+	collectors map[string]prometheus.Collector
+}
+
+func NewRegistry() (*Registry, error) {
+	registry := prometheus.NewRegistry()
+	if _, err := ocprometheus.NewExporter(ocprometheus.Options{Registry: registry}); err != nil {
+		return nil, err
+	}
+
+	return &Registry{
+		registry:   registry,
+		handler:    promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		collectors: map[string]prometheus.Collector{},
+	}, nil
+}
+
+var _ http.Handler = (*Registry)(nil)
+
+// Register adds the collector under the name, replacing the one registered before.
+func (r *Registry) Register(name string, c prometheus.Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.collectors[name]; ok {
+		r.registry.Unregister(old)
+		delete(r.collectors, name)
+	}
+	if err := r.registry.Register(c); err != nil {
+		return err
+	}
+	r.collectors[name] = c
+
+	return nil
+}
+
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.collectors[name]; ok {
+		r.registry.Unregister(c)
+		delete(r.collectors, name)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+func TestRegistry_Views(t *testing.T) {
+	latency := stats.Float64("test/latency", "latency in ms", stats.UnitMilliseconds)
+	method := tag.MustNewKey("method")
+
+	err := view.Register(
+		&view.View{
+			Name:        "test/requests",
+			Description: "Count of requests",
+			Measure:     latency,
+			TagKeys:     []tag.Key{method},
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "test/latency",
+			Description: "Latency of requests",
+			Measure:     latency,
+			Aggregation: view.Distribution(1, 10),
+		},
+	)
+	require.NoError(t, err)
+
+	ctx, err := tag.New(context.Background(), tag.Upsert(method, `Pro"duce`))
+	require.NoError(t, err)
+	stats.Record(ctx, latency.M(5))
+	stats.Record(ctx, latency.M(50))
+
+	got := scrape(t, newRegistry(t))
+	require.Contains(t, got, `# TYPE test_latency histogram
+test_latency_bucket{le="1"} 0
+test_latency_bucket{le="10"} 1
+test_latency_bucket{le="+Inf"} 2
+test_latency_sum 55
+test_latency_count 2
+`)
+	require.Contains(t, got, `test_requests{method="Pro\"duce"} 2`)
+}
+
+func TestRegistry_LogCollector(t *testing.T) {
+	dir, err := os.MkdirTemp("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := log.NewLog(dir, 0, 0, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.SetConfig(log.Config{CacheBytes: 1024}))
+
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = l.Read(2)
+	require.NoError(t, err)
+
+	r := newRegistry(t)
+	require.NoError(t, r.Register("log", LogCollector("test", l)))
+
+	got := scrape(t, r)
+	require.Contains(t, got, `log_segments{topic="test"} 1`)
+	require.Contains(t, got, `log_highest_offset{topic="test"} 2`)
+	require.Contains(t, got, `log_appended_records_total{topic="test"} 3`)
+	require.Contains(t, got, `log_cache_hits_total{topic="test"} 1`)
+
+	offsets, err := log.NewOffsets(dir + ".offsets")
+	require.NoError(t, err)
+	defer os.Remove(dir + ".offsets")
+	require.NoError(t, offsets.Commit("group", 1))
+	require.NoError(t, r.Register("consumer_lag", ConsumerLagCollector("test", l, offsets)))
+	require.Contains(t, scrape(t, r), `consumer_group_lag{group="group",topic="test"} 2`)
+
+	r.Unregister("log")
+	r.Unregister("consumer_lag")
+	got = scrape(t, r)
+	require.NotContains(t, got, "log_segments")
+	require.NotContains(t, got, "consumer_group_lag")
+}
+
+func TestRegistry_ReplicatorCollector(t *testing.T) {
+	r := newRegistry(t)
+	require.NoError(t, r.Register("replicator", ReplicatorCollector(replicationStats{
+		"caught-up": {Replicated: 3, Offset: 2, HighWatermark: 3},
+		"behind":    {Replicated: 3, Offset: 2, HighWatermark: 10},
+		"joined":    {HighWatermark: 4},
+	})))
+
+	got := scrape(t, r)
+	require.Contains(t, got, `replicator_replicated_offset{peer="behind"} 2`)
+	require.Contains(t, got, `replicator_offset_lag{peer="caught-up"} 0`)
+	require.Contains(t, got, `replicator_offset_lag{peer="behind"} 7`)
+	require.Contains(t, got, `replicator_offset_lag{peer="joined"} 4`)
+}
+
+type replicationStats map[string]log.PeerStats
+
+func (s replicationStats) Stats() map[string]log.PeerStats {
+	return s
+}
+
+func newRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r, err := NewRegistry()
+	require.NoError(t, err)
+	return r
+}
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := io.ReadAll(rec.Result().Body)
+	require.NoError(t, err)
+	return string(b)
+}
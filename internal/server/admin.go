@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// AdminLog is implemented by commit logs that can be managed through the Admin service.
+type AdminLog interface {
+	Segments() []log.SegmentInfo
+	Roll() (uint64, error)
+	Truncate(lowest uint64) error
+	DeleteRecords(offset uint64) (uint64, error)
+	Reset() error
+	Config() log.Config
+	SetConfig(log.Config) error
+	Stats() log.Stats
+}
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{Config: config}
+}
+
+func (s *adminServer) ListSegments(_ context.Context, req *api.ListSegmentsRequest) (*api.ListSegmentsResponse, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.ListSegmentsResponse{}
+	for _, seg := range l.Segments() {
+		res.Segments = append(res.Segments, &api.Segment{
+			BaseOffset:   seg.BaseOffset,
+			NextOffset:   seg.NextOffset,
+			StoreBytes:   seg.StoreBytes,
+			IndexBytes:   seg.IndexBytes,
+			Active:       seg.Active,
+			MaxTimestamp: seg.MaxTimestamp,
+			Remote:       seg.Remote,
+		})
+	}
+
+	return res, nil
+}
+
+func (s *adminServer) RollSegment(_ context.Context, req *api.RollSegmentRequest) (*api.RollSegmentResponse, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	off, err := l.Roll()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.RollSegmentResponse{BaseOffset: off}, nil
+}
+
+func (s *adminServer) Truncate(_ context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.Truncate(req.Lowest); err != nil {
+		return nil, err
+	}
+
+	return &api.TruncateResponse{LogStartOffset: l.Stats().LowestOffset}, nil
+}
+
+func (s *adminServer) DeleteRecords(_ context.Context, req *api.DeleteRecordsRequest) (*api.DeleteRecordsResponse, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	off, err := l.DeleteRecords(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.DeleteRecordsResponse{LogStartOffset: off}, nil
+}
+
+func (s *adminServer) Reset(_ context.Context, req *api.ResetRequest) (*api.ResetResponse, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// the log is empty while it's being reset. If the reset fails, it's left in a state
+	// that isn't ready to serve.
+	condition := logReadiness(req.Topic)
+	s.Health.NotReady(condition)
+	if err := l.Reset(); err != nil {
+		return nil, err
+	}
+	s.Health.Ready(condition)
+
+	return &api.ResetResponse{}, nil
+}
+
+func (s *adminServer) GetConfig(_ context.Context, req *api.GetConfigRequest) (*api.LogConfig, error) {
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return toLogConfig(l.Config()), nil
+}
+
+func (s *adminServer) UpdateConfig(_ context.Context, req *api.UpdateConfigRequest) (*api.LogConfig, error) {
+	if req.Config == nil {
+		return nil, status.Error(codes.InvalidArgument, "config is required")
+	}
+	if req.Config.RetentionMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "retention_ms can't be negative")
+	}
+	if req.Config.MaxSegmentAgeMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_segment_age_ms can't be negative")
+	}
+	if req.Config.LocalRetentionMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "local_retention_ms can't be negative")
+	}
+
+	config := log.Config{
+		MaxStoreBytes:       req.Config.MaxStoreBytes,
+		MaxIndexBytes:       req.Config.MaxIndexBytes,
+		RetentionBytes:      req.Config.RetentionBytes,
+		RetentionTime:       time.Duration(req.Config.RetentionMs) * time.Millisecond,
+		MaxSegmentAge:       time.Duration(req.Config.MaxSegmentAgeMs) * time.Millisecond,
+		CacheBytes:          req.Config.CacheBytes,
+		LocalRetentionBytes: req.Config.LocalRetentionBytes,
+		LocalRetentionTime:  time.Duration(req.Config.LocalRetentionMs) * time.Millisecond,
+	}
+	if err := config.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	l, err := s.adminLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.SetConfig(config); err != nil {
+		return nil, err
+	}
+
+	return toLogConfig(l.Config()), nil
+}
+
+func (s *adminServer) GetDiskUsage(_ context.Context, _ *api.GetDiskUsageRequest) (*api.GetDiskUsageResponse, error) {
+	res := &api.GetDiskUsageResponse{}
+	add := func(topic string, l AdminLog) {
+		stats := l.Stats()
+		res.Logs = append(res.Logs, &api.LogUsage{
+			Topic:    topic,
+			Bytes:    stats.Bytes,
+			Segments: uint64(stats.Segments),
+		})
+		res.TotalBytes += stats.Bytes
+	}
+
+	if l, ok := s.CommitLog.(AdminLog); ok {
+		add("", l)
+	}
+	if s.Topics != nil {
+		for _, name := range s.Topics.Names() {
+			t, err := s.Topics.Get(name, false)
+			if err != nil {
+				return nil, err
+			}
+			add(name, t.Log)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *adminServer) ListDataDirs(_ context.Context, _ *api.ListDataDirsRequest) (*api.ListDataDirsResponse, error) {
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics aren't configured")
+	}
+
+	dirs := s.Topics.CheckDirs()
+	s.Health.checkDirs(dirs)
+
+	res := &api.ListDataDirsResponse{}
+	for _, dir := range dirs {
+		d := &api.DataDir{
+			Path:      dir.Path,
+			Online:    dir.Err == nil,
+			FreeBytes: dir.FreeBytes,
+			Topics:    dir.Topics,
+		}
+		if dir.Err != nil {
+			d.Error = dir.Err.Error()
+		}
+		res.Dirs = append(res.Dirs, d)
+	}
+
+	return res, nil
+}
+
+// adminLog returns the log of the topic, or the server's own log for the empty topic.
+func (s *adminServer) adminLog(topic string) (AdminLog, error) {
+	if topic != "" {
+		if s.Topics == nil {
+			return nil, status.Error(codes.Unimplemented, "topics aren't configured")
+		}
+		t, err := s.Topics.Get(topic, false)
+		if err != nil {
+			return nil, err
+		}
+		return t.Log, nil
+	}
+
+	l, ok := s.CommitLog.(AdminLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the commit log can't be managed")
+	}
+	return l, nil
+}
+
+func toLogConfig(c log.Config) *api.LogConfig {
+	return &api.LogConfig{
+		MaxStoreBytes:       c.MaxStoreBytes,
+		MaxIndexBytes:       c.MaxIndexBytes,
+		RetentionBytes:      c.RetentionBytes,
+		RetentionMs:         int64(c.RetentionTime / time.Millisecond),
+		MaxSegmentAgeMs:     int64(c.MaxSegmentAge / time.Millisecond),
+		CacheBytes:          c.CacheBytes,
+		LocalRetentionBytes: c.LocalRetentionBytes,
+		LocalRetentionMs:    int64(c.LocalRetentionTime / time.Millisecond),
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+func TestAdmin(t *testing.T) {
+	cc, commitLog, teardown := setupServerTestConn(t, func(config *Config) {
+		config.InsecureAdmin = true
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	admin := api.NewAdminClient(cc)
+	for i := 0; i < 3; i++ {
+		_, err := commitLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	roll, err := admin.RollSegment(ctx, &api.RollSegmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), roll.BaseOffset)
+
+	segments, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.NoError(t, err)
+	require.Len(t, segments.Segments, 2)
+	require.Equal(t, uint64(0), segments.Segments[0].BaseOffset)
+	require.Equal(t, uint64(3), segments.Segments[0].NextOffset)
+	require.NotZero(t, segments.Segments[0].StoreBytes)
+	require.False(t, segments.Segments[0].Active)
+	require.True(t, segments.Segments[1].Active)
+
+	usage, err := admin.GetDiskUsage(ctx, &api.GetDiskUsageRequest{})
+	require.NoError(t, err)
+	require.Len(t, usage.Logs, 1)
+	require.Equal(t, uint64(2), usage.Logs[0].Segments)
+	require.Equal(t, usage.Logs[0].Bytes, usage.TotalBytes)
+
+	truncate, err := admin.Truncate(ctx, &api.TruncateRequest{Lowest: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), truncate.LogStartOffset)
+
+	deleted, err := admin.DeleteRecords(ctx, &api.DeleteRecordsRequest{Offset: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), deleted.LogStartOffset, "capped at the next offset")
+
+	config, err := admin.GetConfig(ctx, &api.GetConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), config.MaxStoreBytes)
+	config.RetentionBytes = 4096
+	config.MaxSegmentAgeMs = 60000
+	config, err = admin.UpdateConfig(ctx, &api.UpdateConfigRequest{Config: config})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), config.RetentionBytes)
+	require.Equal(t, int64(60000), config.MaxSegmentAgeMs)
+
+	// segments too small to hold a record are rejected.
+	for _, invalid := range []*api.LogConfig{{MaxStoreBytes: 1}, {MaxIndexBytes: 4}} {
+		_, err = admin.UpdateConfig(ctx, &api.UpdateConfigRequest{Config: invalid})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	config, err = admin.GetConfig(ctx, &api.GetConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), config.MaxIndexBytes)
+
+	_, err = admin.Reset(ctx, &api.ResetRequest{})
+	require.NoError(t, err)
+	_, err = commitLog.Read(0)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	off, err := commitLog.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = admin.ListSegments(ctx, &api.ListSegmentsRequest{Topic: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAdmin_DataDirs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "admin-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+	_, err = topics.Get("orders", true)
+	require.NoError(t, err)
+
+	cc, _, teardown := setupServerTestConn(t, func(config *Config) {
+		config.Topics = topics
+		config.InsecureAdmin = true
+	})
+	defer teardown()
+
+	res, err := api.NewAdminClient(cc).ListDataDirs(context.Background(), &api.ListDataDirsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Dirs, 1)
+	require.Equal(t, dir, res.Dirs[0].Path)
+	require.True(t, res.Dirs[0].Online)
+	require.NotZero(t, res.Dirs[0].FreeBytes)
+	require.Equal(t, []string{"orders"}, res.Dirs[0].Topics)
+
+	// the node isn't ready while a data directory is offline.
+	health := healthpb.NewHealthClient(cc)
+	check, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check.Status)
+
+	require.NoError(t, os.RemoveAll(dir))
+	res, err = api.NewAdminClient(cc).ListDataDirs(context.Background(), &api.ListDataDirsRequest{})
+	require.NoError(t, err)
+	require.False(t, res.Dirs[0].Online)
+	check, err = health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check.Status)
+}
+
+func TestAdmin_NotServedWithoutAuthorizer(t *testing.T) {
+	cc, _, teardown := setupServerTestConn(t, nil)
+	defer teardown()
+
+	_, err := api.NewAdminClient(cc).Reset(context.Background(), &api.ResetRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAdmin_Unauthorized(t *testing.T) {
+	policyFile, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policyFile.Name())
+	_, err = policyFile.WriteString("*,*,produce\n*,*,consume\n")
+	require.NoError(t, err)
+	require.NoError(t, policyFile.Close())
+
+	authorizer, err := NewPolicyAuthorizer(policyFile.Name())
+	require.NoError(t, err)
+
+	cc, _, teardown := setupServerTestConn(t, func(config *Config) {
+		config.Authorizer = authorizer
+	})
+	defer teardown()
+
+	_, err = api.NewAdminClient(cc).Reset(context.Background(), &api.ResetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
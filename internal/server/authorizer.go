@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	objectWildcard = "*"
+	produceAction  = "produce"
+	consumeAction  = "consume"
+	adminAction    = "admin"
+	// noAction is required of the methods every client may call.
+	noAction = ""
+)
+
+// methodActions maps the full gRPC method names to the action a subject
+// must be allowed to perform to call them, or to noAction for the methods
+// every client may call. The methods not listed here are denied, so that
+// a method is only served with an Authorizer once it's listed.
+//
+// The action is authorized on the topics of the request, or on "*" for requests
+// to the server's own log. Streams authorize every message they receive.
+// BeginTransaction, CommitTransaction and AbortTransaction only take the ID of a
+// transaction, whose records are authorized as they're produced, and whose
+// subject alone may end it.
+var methodActions = map[string]string{
+	"/log.v1.Log/Produce":           produceAction,
+	"/log.v1.Log/ProduceStream":     produceAction,
+	"/log.v1.Log/Consume":           consumeAction,
+	"/log.v1.Log/ConsumeStream":     consumeAction,
+	"/log.v1.Log/GetServers":        noAction,
+	"/log.v1.Log/CommitOffset":      consumeAction,
+	"/log.v1.Log/FetchOffset":       consumeAction,
+	"/log.v1.Log/GetOffsets":        consumeAction,
+	"/log.v1.Log/InitProducer":      produceAction,
+	"/log.v1.Log/BeginTransaction":  noAction,
+	"/log.v1.Log/AddToTransaction":  produceAction,
+	"/log.v1.Log/CommitTransaction": noAction,
+	"/log.v1.Log/AbortTransaction":  noAction,
+	"/log.v1.Admin/ListSegments":    adminAction,
+	"/log.v1.Admin/RollSegment":     adminAction,
+	"/log.v1.Admin/Truncate":        adminAction,
+	"/log.v1.Admin/DeleteRecords":   adminAction,
+	"/log.v1.Admin/Reset":           adminAction,
+	"/log.v1.Admin/GetConfig":       adminAction,
+	"/log.v1.Admin/UpdateConfig":    adminAction,
+	"/log.v1.Admin/GetDiskUsage":    adminAction,
+	"/log.v1.Admin/ListDataDirs":    adminAction,
+	// the health checks are probed by the load balancers and orchestrators.
+	"/grpc.health.v1.Health/Check": noAction,
+	"/grpc.health.v1.Health/Watch": noAction,
+}
+
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+type policy struct {
+	subject, object, action string
+}
+
+// match reports whether the policy allows the action. A "*" subject only matches
+// the authenticated subjects, so the clients without one are never allowed by it.
+func (p policy) match(subject, object, action string) bool {
+	return (p.subject == objectWildcard && subject != "" || p.subject == subject) &&
+		(p.object == objectWildcard || p.object == object) &&
+		p.action == action
+}
+
+var _ Authorizer = (*PolicyAuthorizer)(nil)
+
+// PolicyAuthorizer authorizes subjects according to a policy file.
+// Each line of the file is a "subject,topic,action" rule,
+// where subject and topic may be "*" to match any of them. The clients that didn't
+// authenticate have an empty subject, which a "*" subject doesn't match.
+// Blank lines and lines starting with "#" are ignored.
+type PolicyAuthorizer struct {
+	policies []policy
+}
+
+func NewPolicyAuthorizer(policyFile string) (*PolicyAuthorizer, error) {
+	f, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &PolicyAuthorizer{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want subject,topic,action, got %q", policyFile, n, line)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		switch fields[2] {
+		case produceAction, consumeAction, adminAction:
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", policyFile, n, fields[2])
+		}
+
+		a.policies = append(a.policies, policy{
+			subject: fields[0],
+			object:  fields[1],
+			action:  fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *PolicyAuthorizer) Authorize(subject, object, action string) error {
+	for _, p := range a.policies {
+		if p.match(subject, object, action) {
+			return nil
+		}
+	}
+
+	return status.New(
+		codes.PermissionDenied,
+		fmt.Sprintf("%s not permitted to %s to %s", subject, action, object),
+	).Err()
+}
+
+type subjectContextKey struct{}
+
+// authenticate extracts the subject from the client certificate, so that
+// later interceptors and handlers can authorize it.
+// Clients connecting without TLS have an empty subject.
+func authenticate(ctx context.Context) (context.Context, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
+	}
+
+	if p.AuthInfo == nil {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+
+	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
+}
+
+func subject(ctx context.Context) string {
+	s, _ := ctx.Value(subjectContextKey{}).(string)
+	return s
+}
+
+// objects returns the topics the request is for, the server's own log being "*".
+func objects(req interface{}) []string {
+	switch req := req.(type) {
+	case interface{ GetTopics() []string }:
+		return req.GetTopics()
+	case interface{ GetTopic() string }:
+		if topic := req.GetTopic(); topic != "" {
+			return []string{topic}
+		}
+	}
+	return []string{objectWildcard}
+}
+
+func authorizeRequest(authorizer Authorizer, subject, action string, req interface{}) error {
+	for _, object := range objects(req) {
+		if err := authorizer.Authorize(subject, object, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// methodAction returns the action the method requires, failing for the methods not listed.
+func methodAction(method string) (string, error) {
+	action, ok := methodActions[method]
+	if !ok {
+		return "", status.Errorf(codes.PermissionDenied, "%s is not permitted", method)
+	}
+	return action, nil
+}
+
+func authorizeUnaryInterceptor(authorizer Authorizer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		action, err := methodAction(info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if action != noAction {
+			if err := authorizeRequest(authorizer, subject(ctx), action, req); err != nil {
+				return nil, err
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func authorizeStreamInterceptor(authorizer Authorizer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		action, err := methodAction(info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if action != noAction {
+			stream = &authorizedStream{ServerStream: stream, authorizer: authorizer, action: action}
+		}
+
+		return handler(srv, stream)
+	}
+}
+
+// authorizedStream authorizes the messages it receives.
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer Authorizer
+	action     string
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return authorizeRequest(s.authorizer, subject(s.Context()), s.action, m)
+}
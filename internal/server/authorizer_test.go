@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+)
+
+func TestPolicyAuthorizer(t *testing.T) {
+	f, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`# subject,topic,action
+root, *, produce
+root, *, consume
+root, *, admin
+nobody, orders, consume
+*, payments, consume
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := NewPolicyAuthorizer(f.Name())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, object, action string
+		permitted               bool
+	}{
+		{"root", objectWildcard, produceAction, true},
+		{"root", "orders", adminAction, true},
+		{"nobody", "orders", consumeAction, true},
+		{"nobody", "orders", produceAction, false},
+		{"nobody", objectWildcard, consumeAction, false},
+		{"", objectWildcard, consumeAction, false},
+		{"nobody", "payments", consumeAction, true},
+		// the wildcard subject doesn't match the clients without a subject.
+		{"", "payments", consumeAction, false},
+	} {
+		err := a.Authorize(tc.subject, tc.object, tc.action)
+		if tc.permitted {
+			require.NoError(t, err, "%+v", tc)
+			continue
+		}
+		require.Equal(t, codes.PermissionDenied, status.Code(err), "%+v", tc)
+	}
+}
+
+func TestNewPolicyAuthorizer_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"root,*\n",
+		"root,*,delete\n",
+	} {
+		f, err := os.CreateTemp("", "policy-*.csv")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(content)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		_, err = NewPolicyAuthorizer(f.Name())
+		require.Error(t, err)
+	}
+}
+
+func TestMethodActions(t *testing.T) {
+	// every method served is listed, since the ones that aren't are denied.
+	for _, desc := range []grpc.ServiceDesc{api.Log_ServiceDesc, api.Admin_ServiceDesc, healthpb.Health_ServiceDesc} {
+		for _, m := range desc.Methods {
+			_, err := methodAction(fmt.Sprintf("/%s/%s", desc.ServiceName, m.MethodName))
+			require.NoError(t, err)
+		}
+		for _, s := range desc.Streams {
+			_, err := methodAction(fmt.Sprintf("/%s/%s", desc.ServiceName, s.StreamName))
+			require.NoError(t, err)
+		}
+	}
+
+	interceptor := authorizeUnaryInterceptor(&PolicyAuthorizer{})
+	handler := func(context.Context, interface{}) (interface{}, error) {
+		return &api.GetServersResponse{}, nil
+	}
+	_, err := interceptor(context.Background(), &api.GetServersRequest{}, &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/GetServers"}, handler)
+	require.NoError(t, err)
+	_, err = interceptor(context.Background(), &api.GetServersRequest{}, &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/Unlisted"}, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{
+					{{Subject: pkix.Name{CommonName: "root"}}},
+				},
+			},
+		},
+	})
+	ctx, err := authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(ctx))
+
+	ctx, err = authenticate(peer.NewContext(context.Background(), &peer.Peer{}))
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	_, err = authenticate(context.Background())
+	require.Error(t, err)
+}
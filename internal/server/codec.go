@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var _ proto.Message = (*encodedMessage)(nil)
+
+// EncodedReader is implemented by commit logs that read the records as they're encoded
+// in their stores, so that they're sent to the consumers without decoding and encoding them.
+type EncodedReader interface {
+	ReadEncoded(dst []byte, off uint64) ([]byte, error)
+}
+
+// encodedMessage is a message already encoded in the protobuf wire format.
+// It implements the legacy Marshal method, which the protobuf runtime calls in place
+// of encoding the message itself, so that gRPC's own codec passes it through as it is.
+// The other messages, and the other services, are left to the codec as usual.
+type encodedMessage struct {
+	b []byte
+}
+
+func (m *encodedMessage) Reset() {
+	m.b = nil
+}
+
+func (m *encodedMessage) String() string {
+	return fmt.Sprintf("encoded message (%d bytes)", len(m.b))
+}
+
+func (*encodedMessage) ProtoMessage() {}
+
+func (m *encodedMessage) Marshal() ([]byte, error) {
+	return m.b, nil
+}
+
+// frameHeaderBytes is the room left in front of a record to prepend the header
+// of the api.ConsumeResponse field holding it: its tag and its length.
+const frameHeaderBytes = 1 + binary.MaxVarintLen64
+
+// consumeResponseFrame reads the record at the offset as an encoded api.ConsumeResponse.
+// The record is read straight after the room left for the header, so that its bytes
+// aren't copied again.
+func consumeResponseFrame(r EncodedReader, off uint64) (*encodedMessage, error) {
+	b, err := r.ReadEncoded(make([]byte, frameHeaderBytes), off)
+	if err != nil {
+		return nil, err
+	}
+
+	// the record is the first field of the response.
+	n := len(b) - frameHeaderBytes
+	var room [frameHeaderBytes]byte
+	header := protowire.AppendTag(room[:0], 1, protowire.BytesType)
+	header = protowire.AppendVarint(header, uint64(n))
+	start := frameHeaderBytes - len(header)
+	copy(b[start:], header)
+
+	return &encodedMessage{b: b[start:]}, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+func TestConsumeResponseFrame(t *testing.T) {
+	l, teardown := setupCodecTest(t, 3, 256)
+	defer teardown()
+
+	for off := uint64(0); off < 3; off++ {
+		frame, err := consumeResponseFrame(l, off)
+		require.NoError(t, err)
+
+		// gRPC's codec passes the frame through as it is.
+		b, err := encoding.GetCodec("proto").Marshal(frame)
+		require.NoError(t, err)
+		require.Equal(t, frame.b, b)
+
+		got := &api.ConsumeResponse{}
+		require.NoError(t, proto.Unmarshal(b, got))
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&api.ConsumeResponse{Record: record}, got))
+	}
+
+	_, err := consumeResponseFrame(l, 3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3, Lowest: 0, Next: 3}, err)
+}
+
+// BenchmarkConsumeResponse compares encoding the records read for the stream consumers,
+// decoded from the log and encoded again, with passing them through as they're encoded.
+func BenchmarkConsumeResponse(b *testing.B) {
+	const records = 1024
+	l, teardown := setupCodecTest(b, records, 1024)
+	defer teardown()
+	codec := encoding.GetCodec("proto")
+
+	b.Run("decoded", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			record, err := l.Read(uint64(i % records))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := codec.Marshal(&api.ConsumeResponse{Record: record}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("encoded", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			frame, err := consumeResponseFrame(l, uint64(i%records))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := codec.Marshal(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func setupCodecTest(t testing.TB, records, size int) (*log.Log, func()) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "codec-test")
+	require.NoError(t, err)
+
+	l, err := log.NewLog(dir, 0, 1<<20, 1<<20)
+	require.NoError(t, err)
+
+	for i := 0; i < records; i++ {
+		_, err := l.Append(&api.Record{
+			Key:   []byte("key"),
+			Value: bytes.Repeat([]byte{'a'}, size),
+		})
+		require.NoError(t, err)
+	}
+
+	return l, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+// Readiness conditions a node usually waits for before serving.
+const (
+	// LogReadiness is met once the log has recovered its segments.
+	LogReadiness = "log"
+	// MembershipReadiness is met once the node has joined the cluster.
+	MembershipReadiness = "membership"
+	// DataDirsReadiness is met while every data directory of the topics is online.
+	DataDirsReadiness = "data_dirs"
+)
+
+// Health is the standard gRPC health service, which reports the node
+// NOT_SERVING until all of its readiness conditions are met.
+// The status is reported for the whole server and for the Log service.
+type Health struct {
+	*health.Server
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+func NewHealth(conditions ...string) *Health {
+	h := &Health{
+		Server:  health.NewServer(),
+		pending: make(map[string]struct{}, len(conditions)),
+	}
+	for _, c := range conditions {
+		h.pending[c] = struct{}{}
+	}
+	h.update()
+
+	return h
+}
+
+// Ready marks the condition as met.
+func (h *Health) Ready(condition string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.pending, condition)
+	h.update()
+}
+
+// NotReady marks the condition as unmet again, e.g. while the log is being reset.
+func (h *Health) NotReady(condition string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pending[condition] = struct{}{}
+	h.update()
+}
+
+func (h *Health) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if len(h.pending) > 0 {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.SetServingStatus("", status)
+	h.SetServingStatus(api.Log_ServiceDesc.ServiceName, status)
+}
+
+// logReadiness returns the condition of the topic's log being ready,
+// or of the server's own log for the empty topic.
+func logReadiness(topic string) string {
+	if topic == "" {
+		return LogReadiness
+	}
+	return LogReadiness + "/" + topic
+}
+
+// checkDirs marks the data directories condition as unmet while any of them is offline.
+func (h *Health) checkDirs(dirs []log.DirStatus) {
+	for _, dir := range dirs {
+		if dir.Err != nil {
+			h.NotReady(DataDirsReadiness)
+			return
+		}
+	}
+	h.Ready(DataDirsReadiness)
+}
+
+// MembershipHandler is told about the servers joining and leaving the cluster,
+// e.g. the replicator.
+type MembershipHandler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// ReadyOnJoin wraps the membership handler, so that the membership condition is met
+// once the handler has joined the first of the node's peers.
+func (h *Health) ReadyOnJoin(handler MembershipHandler) MembershipHandler {
+	return &readyOnJoin{MembershipHandler: handler, health: h}
+}
+
+type readyOnJoin struct {
+	MembershipHandler
+	health *Health
+}
+
+func (j *readyOnJoin) Join(name, addr string) error {
+	if err := j.MembershipHandler.Join(name, addr); err != nil {
+		return err
+	}
+	j.health.Ready(MembershipReadiness)
+	return nil
+}
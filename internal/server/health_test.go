@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth(LogReadiness, MembershipReadiness)
+
+	cc, _, teardown := setupServerTestConn(t, func(config *Config) {
+		config.Health = h
+		config.InsecureAdmin = true
+	})
+	defer teardown()
+
+	client := healthpb.NewHealthClient(cc)
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return res.Status
+	}
+
+	// the server has set up its log, but the node hasn't joined the cluster yet.
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("log.v1.Log"))
+
+	replicator := &log.Replicator{}
+	defer replicator.Close()
+	handler := h.ReadyOnJoin(replicator)
+	require.NoError(t, handler.Join("peer", "127.0.0.1:0"))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check("log.v1.Log"))
+
+	// the log is ready again once it's been reset.
+	_, err := api.NewAdminClient(cc).Reset(context.Background(), &api.ResetRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check("log.v1.Log"))
+
+	h.NotReady(LogReadiness)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("log.v1.Log"))
+}
+
+func TestHealth_Default(t *testing.T) {
+	cc, _, teardown := setupServerTestConn(t, nil)
+	defer teardown()
+
+	res, err := healthpb.NewHealthClient(cc).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+}
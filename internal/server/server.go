@@ -5,6 +5,7 @@ import (
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
@@ -14,15 +15,52 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	api "github.com/kazukousen/go-distributed/api/v1"
+	"github.com/kazukousen/go-distributed/internal/log"
+	"github.com/kazukousen/go-distributed/internal/metrics"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
 
 type grpcServer struct {
 	api.UnimplementedLogServer
-	commitLog CommitLog
+	*Config
+}
+
+type Config struct {
+	CommitLog CommitLog
+	// Authorizer, if set, authorizes every Log RPC against the subject of the client
+	// on the topics of the request. The server's own log, served for the empty topic,
+	// is authorized as the "*" topic.
+	Authorizer Authorizer
+	// InsecureAdmin serves the Admin service without an Authorizer, letting any client
+	// reset, truncate and reconfigure the logs. Otherwise Admin is only served with one.
+	InsecureAdmin bool
+	// Tokens, if set, authenticates clients sending a bearer token
+	// in place of a client certificate.
+	Tokens *TokenAuthenticator
+	// Metrics, if set, exposes the RPC latencies and counts, the state of the commit log
+	// if it reports its stats, and the state of each topic and its consumer groups' lag.
+	Metrics *metrics.Registry
+	// Replicator, if set, reports the replication progress per peer in the metrics.
+	Replicator metrics.ReplicationStatser
+	// Health reports whether the node is ready to serve. The server meets the log
+	// and data directories conditions itself, e.g. while a log is being reset.
+	// If unset, the node is reported SERVING unless one of those is unmet.
+	Health *Health
+	// ServerGetter lists the servers in the cluster for client-side discovery.
+	ServerGetter ServerGetter
+	// Offsets stores the offsets committed by consumer groups.
+	Offsets OffsetStore
+	// Topics, if set, serves the requests for topics other than the server's own log,
+	// creating the topics on their first produce.
+	Topics *log.Topics
+	// Transactions, if set, runs the transactions spanning the topics.
+	Transactions *log.Coordinator
 }
 
 type CommitLog interface {
@@ -30,7 +68,40 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
-func NewGRPCServer(commitLog CommitLog, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
+// ReadCommitter is implemented by commit logs that support transactions,
+// to serve read-committed consumers.
+type ReadCommitter interface {
+	ReadCommitted(uint64) (*api.Record, error)
+}
+
+// ConditionalLog is implemented by commit logs that support conditional appends.
+type ConditionalLog interface {
+	AppendIf(*api.Record, *api.Condition) (uint64, error)
+}
+
+// OffsetGetter is implemented by commit logs that report their offsets.
+type OffsetGetter interface {
+	Bounds() (lowest, next uint64)
+	LastStableOffset() uint64
+	OffsetForTime(timestamp int64) (uint64, bool, error)
+}
+
+// IdempotentLog is implemented by commit logs that suppress the duplicate records
+// of idempotent producers.
+type IdempotentLog interface {
+	InitProducer() (uint64, error)
+}
+
+type OffsetStore interface {
+	Commit(group string, offset uint64) error
+	Fetch(group string) (uint64, bool)
+}
+
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
+}
+
+func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
 	logger := zap.L().Named("server")
 	zapOpts := []grpc_zap.Option{
 		grpc_zap.WithDurationField(
@@ -44,41 +115,135 @@ func NewGRPCServer(commitLog CommitLog, grpcOpts ...grpc.ServerOption) (*grpc.Se
 	if err != nil {
 		return nil, err
 	}
+	if config.Metrics != nil {
+		if err := view.Register(ocgrpc.DefaultServerViews...); err != nil {
+			return nil, err
+		}
+		if l, ok := config.CommitLog.(metrics.LogStatser); ok {
+			if err := config.Metrics.Register("log", metrics.LogCollector(objectWildcard, l)); err != nil {
+				return nil, err
+			}
+			if o, ok := config.Offsets.(metrics.GroupOffsetser); ok {
+				if err := config.Metrics.Register("consumer_lag", metrics.ConsumerLagCollector(objectWildcard, l, o)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if config.Topics != nil {
+			config.Topics.Watch(
+				func(t *log.Topic) {
+					if err := config.Metrics.Register("topic/"+t.Name, metrics.LogCollector(t.Name, t.Log)); err != nil {
+						logger.Error("failed to register the topic's metrics", zap.String("topic", t.Name), zap.Error(err))
+					}
+					if err := config.Metrics.Register("topic/"+t.Name+"/consumer_lag", metrics.ConsumerLagCollector(t.Name, t.Log, t.Offsets)); err != nil {
+						logger.Error("failed to register the topic's metrics", zap.String("topic", t.Name), zap.Error(err))
+					}
+				},
+				func(t *log.Topic) {
+					config.Metrics.Unregister("topic/" + t.Name)
+					config.Metrics.Unregister("topic/" + t.Name + "/consumer_lag")
+				},
+			)
+		}
+		if config.Replicator != nil {
+			if err := config.Metrics.Register("replicator", metrics.ReplicatorCollector(config.Replicator)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(authenticateFunc(config.Tokens)),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(),
+		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
+		grpc_auth.UnaryServerInterceptor(authenticateFunc(config.Tokens)),
+	}
+	if config.Authorizer != nil {
+		streamInterceptors = append(streamInterceptors, authorizeStreamInterceptor(config.Authorizer))
+		unaryInterceptors = append(unaryInterceptors, authorizeUnaryInterceptor(config.Authorizer))
+	}
 
 	grpcOpts = append(grpcOpts,
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_ctxtags.StreamServerInterceptor(),
-				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			),
-		),
-		grpc.UnaryInterceptor(
-			grpc_middleware.ChainUnaryServer(
-				grpc_ctxtags.UnaryServerInterceptor(),
-				grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-			),
-		),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 	)
 	gsrv := grpc.NewServer(grpcOpts...)
-	srv, err := newServer(commitLog)
+	srv, err := newServer(config)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.Health == nil {
+		config.Health = NewHealth(LogReadiness)
+	}
+	// the commit log and the topics are open by now.
+	config.Health.Ready(LogReadiness)
+	if config.Topics != nil {
+		config.Health.checkDirs(config.Topics.CheckDirs())
+	}
+
 	api.RegisterLogServer(gsrv, srv)
+	if config.Authorizer != nil || config.InsecureAdmin {
+		api.RegisterAdminServer(gsrv, newAdminServer(config))
+	}
+	healthpb.RegisterHealthServer(gsrv, config.Health)
 
 	return gsrv, nil
 }
 
-func newServer(commitLog CommitLog) (*grpcServer, error) {
+func newServer(config *Config) (*grpcServer, error) {
 	return &grpcServer{
-		commitLog: commitLog,
+		Config: config,
 	}, nil
 }
 
-func (s *grpcServer) Produce(_ context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	off, err := s.commitLog.Append(req.Record)
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	// streams produce through here too, so the check covers every message they receive.
+	if req.GetRecord() == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	if req.Record.Control != api.Record_NONE {
+		return nil, status.Error(codes.InvalidArgument, "control records are only written by the transaction coordinator")
+	}
+
+	switch req.Condition.GetExpected().(type) {
+	case *api.Condition_KeyOffset, *api.Condition_KeyAbsent:
+		if len(req.Record.Key) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "key conditions require the record to have a key")
+		}
+	}
+
+	if req.Record.TransactionId != 0 {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+		}
+		off, err := s.Transactions.Append(subject(ctx), req.Topic, req.Record, req.Condition)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{Offset: off}, nil
+	}
+
+	commitLog, err := s.commitLog(req.Topic, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var off uint64
+	if req.Condition != nil {
+		conditional, ok := commitLog.(ConditionalLog)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "the commit log doesn't support conditional appends")
+		}
+		off, err = conditional.AppendIf(req.Record, req.Condition)
+	} else {
+		off, err = commitLog.Append(req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +252,17 @@ func (s *grpcServer) Produce(_ context.Context, req *api.ProduceRequest) (*api.P
 }
 
 func (s *grpcServer) Consume(_ context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	rec, err := s.commitLog.Read(req.Offset)
+	commitLog, err := s.commitLog(req.Topic, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec *api.Record
+	if rc, ok := commitLog.(ReadCommitter); ok && req.Isolation == api.ConsumeRequest_READ_COMMITTED {
+		rec, err = rc.ReadCommitted(req.Offset)
+	} else {
+		rec, err = commitLog.Read(req.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -113,26 +288,231 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	consume := func() (interface{}, uint64, error) {
+		res, err := s.Consume(stream.Context(), req)
+		if err != nil {
+			return nil, 0, err
+		}
+		// read-committed reads skip the records that aren't visible.
+		return res, res.Record.Offset + 1, nil
+	}
+	if r, ok := s.encodedReader(req); ok {
+		// sends the records as they're encoded in the log.
+		consume = func() (interface{}, uint64, error) {
+			frame, err := consumeResponseFrame(r, req.Offset)
+			return frame, req.Offset + 1, err
+		}
+	}
+
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
+			res, next, err := consume()
+			switch err := err.(type) {
 			case nil:
 				// pass through
 			case api.ErrOffsetOutOfRange:
+				if err.Offset < err.Lowest {
+					// the offset has been truncated, so it'll never be readable.
+					return err
+				}
 				continue
 			default:
 				return err
 			}
 
-			if err = stream.Send(res); err != nil {
+			if err = stream.SendMsg(res); err != nil {
 				return err
 			}
 
-			req.Offset++
+			req.Offset = next
+		}
+	}
+}
+
+// encodedReader returns the log to read the encoded records from for the request,
+// unless they need to be decoded to filter them.
+func (s *grpcServer) encodedReader(req *api.ConsumeRequest) (EncodedReader, bool) {
+	if req.Isolation == api.ConsumeRequest_READ_COMMITTED {
+		return nil, false
+	}
+	commitLog, err := s.commitLog(req.Topic, false)
+	if err != nil {
+		return nil, false
+	}
+	r, ok := commitLog.(EncodedReader)
+	return r, ok
+}
+
+func (s *grpcServer) GetServers(_ context.Context, _ *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if s.ServerGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "server discovery isn't configured")
+	}
+
+	servers, err := s.ServerGetter.GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+
+	if req.TransactionId != 0 {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+		}
+		if err := s.Transactions.CommitOffset(req.TransactionId, subject(ctx), req.Topic, req.Group, req.Offset); err != nil {
+			return nil, err
 		}
+		return &api.CommitOffsetResponse{}, nil
 	}
+
+	offsets, err := s.offsets(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := offsets.Commit(req.Group, req.Offset); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(_ context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	offsets, err := s.offsets(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	off, ok := offsets.Fetch(req.Group)
+	return &api.FetchOffsetResponse{Offset: off, Found: ok}, nil
+}
+
+func (s *grpcServer) InitProducer(_ context.Context, _ *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	l, ok := s.CommitLog.(IdempotentLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the commit log doesn't support idempotent producers")
+	}
+
+	id, err := l.InitProducer()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.InitProducerResponse{ProducerId: id}, nil
+}
+
+func (s *grpcServer) BeginTransaction(ctx context.Context, _ *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+	}
+
+	id, err := s.Transactions.Begin(subject(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+func (s *grpcServer) AddToTransaction(ctx context.Context, req *api.AddToTransactionRequest) (*api.AddToTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+	}
+
+	if err := s.Transactions.Add(req.TransactionId, subject(ctx), req.Topics...); err != nil {
+		return nil, err
+	}
+
+	return &api.AddToTransactionResponse{}, nil
+}
+
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.CommitTransactionRequest) (*api.CommitTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+	}
+
+	if err := s.Transactions.Commit(req.TransactionId, subject(ctx)); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitTransactionResponse{}, nil
+}
+
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.AbortTransactionRequest) (*api.AbortTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't configured")
+	}
+
+	if err := s.Transactions.Abort(req.TransactionId, subject(ctx)); err != nil {
+		return nil, err
+	}
+
+	return &api.AbortTransactionResponse{}, nil
+}
+
+// commitLog returns the log of the topic, or the server's own log for the empty topic.
+func (s *grpcServer) commitLog(topic string, create bool) (CommitLog, error) {
+	if topic == "" {
+		return s.CommitLog, nil
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics aren't configured")
+	}
+
+	t, err := s.Topics.Get(topic, create)
+	if err != nil {
+		return nil, err
+	}
+	return t.Log, nil
+}
+
+// offsets returns the offsets of the topic's consumer groups,
+// or of the server's own log for the empty topic.
+func (s *grpcServer) offsets(topic string) (OffsetStore, error) {
+	if topic == "" {
+		if s.Offsets == nil {
+			return nil, status.Error(codes.Unimplemented, "consumer offsets aren't configured")
+		}
+		return s.Offsets, nil
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics aren't configured")
+	}
+
+	t, err := s.Topics.Get(topic, false)
+	if err != nil {
+		return nil, err
+	}
+	return t.Offsets, nil
+}
+
+func (s *grpcServer) GetOffsets(_ context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	commitLog, err := s.commitLog(req.Topic, false)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := commitLog.(OffsetGetter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the commit log doesn't report its offsets")
+	}
+
+	res := &api.GetOffsetsResponse{LastStableOffset: l.LastStableOffset()}
+	res.LogStartOffset, res.HighWatermark = l.Bounds()
+	if req.Timestamp != 0 {
+		res.TimestampOffset, res.TimestampFound, err = l.OffsetForTime(req.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
 }
@@ -4,7 +4,9 @@ import (
 	"context"
 	"flag"
 	"net"
+	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -12,10 +14,13 @@ import (
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	api "github.com/kazukousen/go-distributed/api/v1"
 	"github.com/kazukousen/go-distributed/internal/log"
+	"github.com/kazukousen/go-distributed/internal/metrics"
 )
 
 var testDebug = flag.Bool("debug", false, "enable observability for debugging")
@@ -39,10 +44,14 @@ func TestGRPCServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds": testGRPCServer_ProduceComsume,
 		"produce/consume stream succeeds":                    testGrpcServer_ConsumePastBoundary,
 		"consume past log boundary fails":                    testGrpcServer_ProduceConsumeStream,
+		"idempotent produce suppresses duplicates":           testGRPCServer_IdempotentProduce,
+		"conditional produce fails once the log moved on":    testGRPCServer_ConditionalProduce,
+		"get offsets":                    testGRPCServer_GetOffsets,
+		"produce without a record fails": testGRPCServer_ProduceWithoutRecord,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 
-			client, commitLog, teardown := setupServerTest(t)
+			client, commitLog, teardown := setupServerTest(t, nil)
 			defer teardown()
 
 			f(t, client, commitLog)
@@ -119,15 +128,212 @@ func testGrpcServer_ProduceConsumeStream(t *testing.T, client api.LogClient, com
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
 }
 
-func setupServerTest(t *testing.T) (client api.LogClient, commitLog CommitLog, teardown func()) {
+func testGRPCServer_IdempotentProduce(t *testing.T, client api.LogClient, commitLog CommitLog) {
+	ctx := context.Background()
+
+	init, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, init.ProducerId)
+
+	record := &api.Record{Value: []byte("hello world"), ProducerId: init.ProducerId}
+	for i := 0; i < 2; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produce.Offset)
+	}
+
+	record.Sequence = 2
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testGRPCServer_ConditionalProduce(t *testing.T, client api.LogClient, commitLog CommitLog) {
+	ctx := context.Background()
+
+	req := &api.ProduceRequest{
+		Record:    &api.Record{Key: []byte("key"), Value: []byte("hello world")},
+		Condition: &api.Condition{Expected: &api.Condition_NextOffset{NextOffset: 0}},
+	}
+	produce, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	failed, ok := api.AsErrConditionFailed(err)
+	require.True(t, ok)
+	require.Equal(t, api.ErrConditionFailed{NextOffset: 1, KeyOffset: 0, KeyFound: true}, failed)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("hello world")},
+		Condition: &api.Condition{Expected: &api.Condition_KeyAbsent{KeyAbsent: true}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testGRPCServer_GetOffsets(t *testing.T, client api.LogClient, commitLog CommitLog) {
+	ctx := context.Background()
+
+	for _, ts := range []int64{10, 20} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world"), Timestamp: ts}})
+		require.NoError(t, err)
+	}
+
+	res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Timestamp: 15})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LogStartOffset)
+	require.Equal(t, uint64(2), res.HighWatermark)
+	require.Equal(t, uint64(2), res.LastStableOffset)
+	require.True(t, res.TimestampFound)
+	require.Equal(t, uint64(1), res.TimestampOffset)
+
+	res, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{Timestamp: 30})
+	require.NoError(t, err)
+	require.False(t, res.TimestampFound)
+}
+
+func testGRPCServer_ProduceWithoutRecord(t *testing.T, client api.LogClient, commitLog CommitLog) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the server is still up.
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+}
+
+func TestGRPCServer_Unauthorized(t *testing.T) {
+	policyFile, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policyFile.Name())
+	_, err = policyFile.WriteString("*,*,consume\n")
+	require.NoError(t, err)
+	require.NoError(t, policyFile.Close())
+
+	authorizer, err := NewPolicyAuthorizer(policyFile.Name())
+	require.NoError(t, err)
+	tokens, err := NewTokenAuthenticator(TokenConfig{JWTKey: []byte("signing-key")})
+	require.NoError(t, err)
+	defer tokens.Close()
+
+	client, _, teardown := setupServerTest(t, func(config *Config) {
+		config.Authorizer = authorizer
+		config.Tokens = tokens
+	})
+	defer teardown()
+
+	// the wildcard subject doesn't match the clients that didn't authenticate.
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signTestJWT([]byte("signing-key"), `{"sub":"client"}`))
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Nil(t, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// consuming is permitted, so the request reaches the log.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func TestGRPCServer_Metrics(t *testing.T) {
+	registry, err := metrics.NewRegistry()
+	require.NoError(t, err)
+	replicator := &log.Replicator{}
+	defer replicator.Close()
+	require.NoError(t, replicator.Join("peer", "127.0.0.1:0"))
+	client, _, teardown := setupServerTest(t, func(config *Config) {
+		config.Metrics = registry
+		config.Replicator = replicator
+	})
+	defer teardown()
+
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	require.Contains(t, body, `grpc_server_method="log.v1.Log/Produce"`)
+	require.Contains(t, body, `log_appended_records_total{topic="*"} 1`)
+	require.Contains(t, body, `replicator_replicated_records_total{peer="peer"} 0`)
+	require.Contains(t, body, `replicator_offset_lag{peer="peer"} 0`)
+}
+
+func TestGRPCServer_TopicMetrics(t *testing.T) {
+	registry, err := metrics.NewRegistry()
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+	// the topics opened before the server are reported as well as the ones created after.
+	_, err = topics.Get("orders", true)
+	require.NoError(t, err)
+
+	client, _, teardown := setupServerTest(t, func(config *Config) {
+		config.Metrics = registry
+		config.Topics = topics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for _, topic := range []string{"orders", "orders", "payments"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Topic: topic, Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Topic: "orders", Group: "group", Offset: 1})
+	require.NoError(t, err)
+
+	body := scrapeMetrics(t, registry)
+	require.Contains(t, body, `log_appended_records_total{topic="orders"} 2`)
+	require.Contains(t, body, `log_appended_records_total{topic="payments"} 1`)
+	require.Contains(t, body, `consumer_group_lag{group="group",topic="orders"} 1`)
+
+	// the closed topics are no longer reported.
+	require.NoError(t, topics.Close())
+	require.NotContains(t, scrapeMetrics(t, registry), `topic="orders"`)
+}
+
+func scrapeMetrics(t *testing.T, registry *metrics.Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func setupServerTest(t *testing.T, fn func(config *Config)) (client api.LogClient, commitLog CommitLog, teardown func()) {
+	t.Helper()
+
+	cc, commitLog, teardown := setupServerTestConn(t, fn)
+	return api.NewLogClient(cc), commitLog, teardown
+}
+
+func setupServerTestConn(t *testing.T, fn func(config *Config)) (cc *grpc.ClientConn, commitLog CommitLog, teardown func()) {
 	t.Helper()
 
 	l, err := net.Listen("tcp", ":0")
@@ -139,7 +345,14 @@ func setupServerTest(t *testing.T) (client api.LogClient, commitLog CommitLog, t
 	cLog, err := log.NewLog(dir, 0, 0, 0)
 	require.NoError(t, err)
 
-	server, err := NewGRPCServer(cLog)
+	config := &Config{
+		CommitLog: cLog,
+	}
+	if fn != nil {
+		fn(config)
+	}
+
+	server, err := NewGRPCServer(config)
 	require.NoError(t, err)
 
 	go func() {
@@ -147,11 +360,9 @@ func setupServerTest(t *testing.T) (client api.LogClient, commitLog CommitLog, t
 	}()
 
 	cliOpts := []grpc.DialOption{grpc.WithInsecure()}
-	cc, err := grpc.Dial(l.Addr().String(), cliOpts...)
+	cc, err = grpc.Dial(l.Addr().String(), cliOpts...)
 	require.NoError(t, err)
 
-	client = api.NewLogClient(cc)
-
 	var telemetryExporter *exporter.LogExporter
 	if *testDebug {
 		metricsLogFile, err := os.CreateTemp("", "metrics-*.log")
@@ -172,7 +383,7 @@ func setupServerTest(t *testing.T) (client api.LogClient, commitLog CommitLog, t
 		require.NoError(t, err)
 	}
 
-	return client, cLog, func() {
+	return cc, cLog, func() {
 		server.Stop()
 		cc.Close()
 		l.Close()
@@ -184,3 +395,161 @@ func setupServerTest(t *testing.T) (client api.LogClient, commitLog CommitLog, t
 		}
 	}
 }
+
+func TestGRPCServer_Transactions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-transactions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(path.Join(dir, "topics"), 0755))
+	topics, err := log.NewTopics(path.Join(dir, "topics"), 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	coordinator, err := log.NewCoordinator(path.Join(dir, "transactions.json"), topics, 0)
+	require.NoError(t, err)
+	defer coordinator.Close()
+
+	tokens, err := NewTokenAuthenticator(TokenConfig{JWTKey: []byte("signing-key")})
+	require.NoError(t, err)
+	defer tokens.Close()
+
+	client, _, teardown := setupServerTest(t, func(config *Config) {
+		config.Topics = topics
+		config.Transactions = coordinator
+		config.Tokens = tokens
+	})
+	defer teardown()
+
+	ctx := context.Background()
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "in", Record: &api.Record{Value: []byte("in")}})
+	require.NoError(t, err)
+
+	// consumes "in" and produces to "out" within a transaction.
+	begin, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	txn := begin.TransactionId
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "out", Record: &api.Record{Value: []byte("out"), TransactionId: txn}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.AddToTransaction(ctx, &api.AddToTransactionRequest{TransactionId: txn, Topics: []string{"out"}})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "out", Record: &api.Record{Value: []byte("out"), TransactionId: txn}})
+		require.NoError(t, err)
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Topic: "in", Group: "group", Offset: 1, TransactionId: txn})
+	require.NoError(t, err)
+
+	// another subject can't use the transaction, let alone end it.
+	other := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+signTestJWT([]byte("signing-key"), `{"sub":"nobody"}`))
+	_, err = client.Produce(other, &api.ProduceRequest{Topic: "out", Record: &api.Record{Value: []byte("other"), TransactionId: txn}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.AbortTransaction(other, &api.AbortTransactionRequest{TransactionId: txn})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.CommitTransaction(other, &api.CommitTransactionRequest{TransactionId: txn})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the open transaction is only visible to read-uncommitted reads.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "out", Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "out", Offset: 0, Isolation: api.ConsumeRequest_READ_COMMITTED})
+	outOfRange, ok := api.AsErrOffsetOutOfRange(err)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), outOfRange.Next)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Topic: "in", Group: "group"})
+	require.NoError(t, err)
+	require.False(t, fetch.Found)
+
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionId: txn})
+	require.NoError(t, err)
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionId: txn})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	for i := uint64(0); i < 2; i++ {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "out", Offset: i, Isolation: api.ConsumeRequest_READ_COMMITTED})
+		require.NoError(t, err)
+		require.Equal(t, i, consume.Record.Offset)
+	}
+	fetch, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Topic: "in", Group: "group"})
+	require.NoError(t, err)
+	require.True(t, fetch.Found)
+	require.Equal(t, uint64(1), fetch.Offset)
+
+	// the records of aborted transactions, and the control records, are skipped.
+	begin, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	_, err = client.AddToTransaction(ctx, &api.AddToTransactionRequest{TransactionId: begin.TransactionId, Topics: []string{"out"}})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "out", Record: &api.Record{Value: []byte("aborted"), TransactionId: begin.TransactionId}})
+	require.NoError(t, err)
+	_, err = client.AbortTransaction(ctx, &api.AbortTransactionRequest{TransactionId: begin.TransactionId})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "out", Record: &api.Record{Value: []byte("after")}})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "out", Offset: 0, Isolation: api.ConsumeRequest_READ_COMMITTED})
+	require.NoError(t, err)
+	var values []string
+	for i := 0; i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		values = append(values, string(res.Record.Value))
+	}
+	require.Equal(t, []string{"out", "out", "after"}, values)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "out", Record: &api.Record{Control: api.Record_COMMIT}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCServer_TopicAuthorization(t *testing.T) {
+	policyFile, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policyFile.Name())
+	_, err = policyFile.WriteString("*,orders,produce\n")
+	require.NoError(t, err)
+	require.NoError(t, policyFile.Close())
+
+	authorizer, err := NewPolicyAuthorizer(policyFile.Name())
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewTopics(dir, 0, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	tokens, err := NewTokenAuthenticator(TokenConfig{JWTKey: []byte("signing-key")})
+	require.NoError(t, err)
+	defer tokens.Close()
+
+	client, _, teardown := setupServerTest(t, func(config *Config) {
+		config.Authorizer = authorizer
+		config.Topics = topics
+		config.Tokens = tokens
+	})
+	defer teardown()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signTestJWT([]byte("signing-key"), `{"sub":"client"}`))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "payments", Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// streams authorize every message.
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("hello world")}}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Topic: "payments", Record: &api.Record{Value: []byte("hello world")}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
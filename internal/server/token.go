@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const defaultTokenReloadInterval = 10 * time.Second
+
+var errInvalidToken = errors.New("invalid token")
+
+type TokenConfig struct {
+	// TokenFile lists static tokens as "token,subject" lines.
+	// Blank lines and lines starting with "#" are ignored.
+	// The file is reloaded whenever it changes.
+	TokenFile string
+	// JWTKey verifies HMAC signed JWTs (HS256, HS384 and HS512),
+	// whose "sub" claim becomes the subject.
+	JWTKey []byte
+	// ReloadInterval is how often TokenFile is checked for changes.
+	ReloadInterval time.Duration
+}
+
+// TokenAuthenticator maps bearer tokens to subjects,
+// for clients which cannot authenticate with a certificate.
+type TokenAuthenticator struct {
+	TokenConfig
+
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	tokens  map[string]string
+	modTime time.Time
+	size    int64
+
+	close chan struct{}
+	done  chan struct{}
+}
+
+func NewTokenAuthenticator(config TokenConfig) (*TokenAuthenticator, error) {
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = defaultTokenReloadInterval
+	}
+
+	a := &TokenAuthenticator{
+		TokenConfig: config,
+		logger:      zap.L().Named("token"),
+		tokens:      map[string]string{},
+		close:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if a.TokenFile == "" {
+		close(a.done)
+		return a, nil
+	}
+
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+
+	go a.watch()
+
+	return a, nil
+}
+
+// Authenticate returns the subject the token belongs to.
+func (a *TokenAuthenticator) Authenticate(token string) (string, error) {
+	a.mu.RLock()
+	subject, ok := a.tokens[token]
+	a.mu.RUnlock()
+	if ok {
+		return subject, nil
+	}
+
+	if len(a.JWTKey) > 0 && strings.Count(token, ".") == 2 {
+		return verifyJWT(token, a.JWTKey, time.Now())
+	}
+
+	return "", errInvalidToken
+}
+
+func (a *TokenAuthenticator) Close() error {
+	select {
+	case <-a.close:
+	default:
+		close(a.close)
+	}
+	<-a.done
+	return nil
+}
+
+func (a *TokenAuthenticator) watch() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.close:
+			return
+		case <-ticker.C:
+			reloaded, err := a.reload()
+			if err != nil {
+				// keep serving the tokens we've got
+				a.logger.Error("failed to reload token file", zap.String("file", a.TokenFile), zap.Error(err))
+				continue
+			}
+			if reloaded {
+				a.logger.Info("reloaded token file", zap.String("file", a.TokenFile))
+			}
+		}
+	}
+}
+
+// reload reads the token file if it has changed since the last read.
+func (a *TokenAuthenticator) reload() (bool, error) {
+	fi, err := os.Stat(a.TokenFile)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.RLock()
+	unchanged := fi.ModTime().Equal(a.modTime) && fi.Size() == a.size
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	tokens, err := readTokenFile(a.TokenFile)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+	a.mu.Unlock()
+
+	return true, nil
+}
+
+func readTokenFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want token,subject", name, n)
+		}
+		tokens[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+var jwtAlgs = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+func verifyJWT(token string, key []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	alg, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported alg %q", errInvalidToken, header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	mac := hmac.New(alg, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", fmt.Errorf("%w: signature mismatch", errInvalidToken)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return "", fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if claims.Nbf != 0 && now.Unix() < claims.Nbf {
+		return "", fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if claims.Sub == "" {
+		return "", fmt.Errorf("%w: missing subject", errInvalidToken)
+	}
+
+	return claims.Sub, nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// authenticateFunc authenticates clients sending a bearer token with the tokens,
+// and falls back to the client certificate otherwise.
+func authenticateFunc(tokens *TokenAuthenticator) grpc_auth.AuthFunc {
+	if tokens == nil {
+		return authenticate
+	}
+
+	return func(ctx context.Context) (context.Context, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get("authorization")) == 0 {
+			return authenticate(ctx)
+		}
+
+		token, err := grpc_auth.AuthFromMD(ctx, "bearer")
+		if err != nil {
+			return ctx, err
+		}
+
+		subject, err := tokens.Authenticate(token)
+		if err != nil {
+			return ctx, status.New(codes.Unauthenticated, err.Error()).Err()
+		}
+
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
+}
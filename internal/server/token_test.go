@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenAuthenticator_TokenFile(t *testing.T) {
+	f, err := os.CreateTemp("", "tokens-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# token,subject\nsecret,root\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := NewTokenAuthenticator(TokenConfig{
+		TokenFile:      f.Name(),
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer a.Close()
+
+	sub, err := a.Authenticate("secret")
+	require.NoError(t, err)
+	require.Equal(t, "root", sub)
+
+	_, err = a.Authenticate("other")
+	require.Error(t, err)
+
+	// rotate the token
+	require.NoError(t, os.WriteFile(f.Name(), []byte("rotated,root\nother,nobody\n"), 0644))
+
+	require.Eventually(t, func() bool {
+		sub, err := a.Authenticate("other")
+		return err == nil && sub == "nobody"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = a.Authenticate("secret")
+	require.Error(t, err)
+}
+
+func TestTokenAuthenticator_JWT(t *testing.T) {
+	key := []byte("signing-key")
+	a, err := NewTokenAuthenticator(TokenConfig{JWTKey: key})
+	require.NoError(t, err)
+	defer a.Close()
+
+	now := time.Now().Unix()
+
+	sub, err := a.Authenticate(signTestJWT(key, fmt.Sprintf(`{"sub":"root","exp":%d}`, now+60)))
+	require.NoError(t, err)
+	require.Equal(t, "root", sub)
+
+	for _, token := range []string{
+		signTestJWT(key, fmt.Sprintf(`{"sub":"root","exp":%d}`, now-60)),
+		signTestJWT(key, fmt.Sprintf(`{"sub":"root","nbf":%d}`, now+60)),
+		signTestJWT(key, `{"exp":0}`),
+		signTestJWT([]byte("other-key"), `{"sub":"root"}`),
+		"not.a.jwt",
+	} {
+		_, err := a.Authenticate(token)
+		require.Error(t, err, token)
+	}
+}
+
+func TestAuthenticateFunc(t *testing.T) {
+	a, err := NewTokenAuthenticator(TokenConfig{JWTKey: []byte("signing-key")})
+	require.NoError(t, err)
+	defer a.Close()
+
+	auth := authenticateFunc(a)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{})
+
+	token := signTestJWT([]byte("signing-key"), `{"sub":"root"}`)
+	got, err := auth(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token)))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(got))
+
+	_, err = auth(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer invalid")))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// without a token, fall back to the client certificate.
+	got, err = auth(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "", subject(got))
+}
+
+func signTestJWT(key []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signing))
+	return signing + "." + enc.EncodeToString(mac.Sum(nil))
+}